@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Command files. "source <file>" runs the commands in it a line at a time,
+// as if they were typed, except that if/while/repeat blocks can go over
+// several lines like in a macro. A line that fails is logged and we carry
+// on, unless it's "source -e", which stops there. After login (and once
+// the listing has loaded) we source ~/.debuggerrc and then ./.debuggerrc,
+// so a challenge's setup (symbols, breakpoints, layout) can live with its
+// code.
+
+// rcFiles are the startup files that exist, in the order we run them
+func rcFiles() []string {
+	files := []string{}
+	seen := map[string]bool{}
+
+	for _, file := range []string{filepath.Join(os.Getenv("HOME"), ".debuggerrc"), ".debuggerrc"} {
+		abs, err := filepath.Abs(file)
+		if err != nil || seen[abs] {
+			continue
+		}
+		seen[abs] = true
+
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
+
+// rcWait is how long we'll wait for the listing before running the startup
+// files anyway
+const rcWait = 15 * time.Second
+
+// sourceMaxDepth is how deeply files can source files
+const sourceMaxDepth = 16
+
+// runRCFiles sources the startup files; it's called once everything's
+// running, since they can do anything a command can, and waits for the
+// listing so "break main" works
+func runRCFiles() {
+	files := rcFiles()
+	if len(files) == 0 {
+		return
+	}
+
+	select {
+	case <-Listing.loaded:
+	case <-time.After(rcWait):
+		logf("no program listing yet; running %s anyway", strings.Join(files, " and "))
+	}
+
+	for _, file := range files {
+		CommandLine.deliver(event{kind: COMMAND, data: "source " + file})
+	}
+}
+
+func expandHome(file string) string {
+	if file == "~" || strings.HasPrefix(file, "~/") {
+		return filepath.Join(os.Getenv("HOME"), file[1:])
+	}
+	return file
+}
+
+// source runs file, returning false if it stopped early
+func (self *commandLine) source(file string, stopOnError bool) bool {
+	if self.sourceDepth >= sourceMaxDepth {
+		logf("%s: files sourcing files too deep", file)
+		return false
+	}
+
+	self.sourceDepth++
+	defer func() { self.sourceDepth-- }()
+
+	buf, err := ioutil.ReadFile(expandHome(file))
+	if err != nil {
+		logf("%s", err)
+		return false
+	}
+
+	ok := true
+	depth := 0
+	block := []string{}
+	start := 0
+
+	for n, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// gather up a block until its end, and run it all at once
+		if word, _ := firstWord(line); self.defining == nil && (depth > 0 || blockDelta(word) > 0) {
+			if depth == 0 {
+				start = n
+			}
+			for _, stmt := range splitStatements(line) {
+				depth += blockDelta(stmt)
+			}
+			block = append(block, line)
+			if depth > 0 {
+				continue
+			}
+
+			line = strings.Join(block, "; ")
+			block, depth = nil, 0
+			n = start
+		}
+
+		if !self.parse(line) {
+			logf("%s:%d: failed", file, n+1)
+			ok = false
+			if stopOnError {
+				return false
+			}
+		}
+	}
+
+	if depth > 0 {
+		logf("%s:%d: '%s' has no end", file, start+1, block[0])
+		ok = false
+	}
+
+	// a define without an end shouldn't swallow what's typed next
+	if self.defining != nil {
+		logf("%s: define %s has no end", file, self.defining.name)
+		self.defining = nil
+		ok = false
+	}
+
+	return ok
+}
+
+// sourceCommand is "source"; it fails if the file did, so "source -e" in a
+// file or macro stops that too
+func (self *commandLine) sourceCommand(line string) bool {
+	_, rest := firstWord(line)
+
+	stopOnError := false
+	if word, file := firstWord(rest); word == "-e" {
+		stopOnError = true
+		rest = file
+	}
+
+	if rest == "" {
+		logf("source [-e] <file>")
+		return false
+	}
+
+	if !self.source(rest, stopOnError) {
+		if stopOnError {
+			logf("stopped running %s", rest)
+		}
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+)
+
+// Command history. It's kept in ~/.debugger_history between sessions, most
+// recent last, with no duplicates; commands are added to the end of the file
+// as they're run, and repeats are weeded out when it's loaded. "!!" runs the last command again, "!n"
+// runs command n, and "!foo" the last one starting with foo. C-r searches
+// backwards as you type, like a shell: C-r again for an older match, Enter
+// to run it, Esc to give up, anything else to edit it.
+
+// historyMax is how many commands we keep
+const historyMax = 1000
+
+func historyFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".debugger_history")
+}
+
+func (self *commandLine) loadHistory() {
+	buf, err := ioutil.ReadFile(historyFile())
+	if err != nil {
+		return
+	}
+
+	lines := strings.Split(strings.TrimRight(string(buf), "\n"), "\n")
+
+	self.historyLock.Lock()
+	defer self.historyLock.Unlock()
+
+	for _, line := range lines {
+		self.remember(line)
+	}
+
+	// commands are appended as they're run, so the file collects
+	// duplicates; write it back as what we kept
+	if len(self.history) < len(lines) {
+		self.saveHistory()
+	}
+}
+
+// saveHistory rewrites the history file; call it with historyLock held
+func (self *commandLine) saveHistory() {
+	f, err := os.Create(historyFile())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	for _, line := range self.history {
+		fmt.Fprintf(f, "%s\n", line)
+	}
+}
+
+// remember makes line the most recent command; call it with historyLock
+// held
+func (self *commandLine) remember(line string) {
+	if line == "" {
+		return
+	}
+
+	for i, old := range self.history {
+		if old == line {
+			self.history = append(self.history[:i], self.history[i+1:]...)
+			break
+		}
+	}
+
+	self.history = append(self.history, line)
+	if len(self.history) > historyMax {
+		self.history = self.history[len(self.history)-historyMax:]
+	}
+	self.historyPos = len(self.history)
+}
+
+// addHistory makes line the most recent command, and adds it to the end of
+// the history file
+func (self *commandLine) addHistory(line string) {
+	if line == "" {
+		return
+	}
+
+	self.historyLock.Lock()
+	self.remember(line)
+	self.historyLock.Unlock()
+
+	f, err := os.OpenFile(historyFile(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(f, "%s\n", line)
+	f.Close()
+}
+
+// clearHistory forgets every command, here and in the history file
+func (self *commandLine) clearHistory() {
+	self.historyLock.Lock()
+	defer self.historyLock.Unlock()
+
+	self.history = nil
+	self.historyPos = 0
+	self.saveHistory()
+}
+
+// moveHistory moves back (or forward, if delta is positive) through the
+// history for the up and down keys, returning the command it lands on
+func (self *commandLine) moveHistory(delta int) (string, bool) {
+	self.historyLock.Lock()
+	defer self.historyLock.Unlock()
+
+	if len(self.history) == 0 {
+		return "", false
+	}
+
+	self.historyPos += delta
+	if self.historyPos < 0 {
+		self.historyPos = 0
+	}
+	if self.historyPos >= len(self.history) {
+		self.historyPos = len(self.history) - 1
+	}
+
+	return self.history[self.historyPos], true
+}
+
+// historyLen is how many commands are in the history
+func (self *commandLine) historyLen() int {
+	self.historyLock.Lock()
+	defer self.historyLock.Unlock()
+
+	return len(self.history)
+}
+
+// expandHistory turns "!!", "!n" and "!prefix" into the commands they mean
+func (self *commandLine) expandHistory(line string) (string, error) {
+	if !strings.HasPrefix(line, "!") || len(line) < 2 {
+		return line, nil
+	}
+
+	self.historyLock.Lock()
+	defer self.historyLock.Unlock()
+
+	ref := line[1:]
+	if ref == "!" {
+		ref = strconv.Itoa(len(self.history))
+	}
+
+	if n, err := strconv.Atoi(ref); err == nil {
+		if n < 1 || n > len(self.history) {
+			return "", fmt.Errorf("no command %d in history", n)
+		}
+		return self.history[n-1], nil
+	}
+
+	for i := len(self.history) - 1; i >= 0; i-- {
+		if strings.HasPrefix(self.history[i], ref) {
+			return self.history[i], nil
+		}
+	}
+
+	return "", fmt.Errorf("nothing in history starts with '%s'", ref)
+}
+
+// showHistory logs the last n commands, numbered for "!n"
+func (self *commandLine) showHistory(n int) {
+	self.historyLock.Lock()
+	defer self.historyLock.Unlock()
+
+	first := len(self.history) - n
+	if first < 0 {
+		first = 0
+	}
+
+	for i := first; i < len(self.history); i++ {
+		logf("%4d  %s", i+1, self.history[i])
+	}
+}
+
+// The rest is reverse search, which happens entirely on the gocui
+// goroutine, since that's where keys arrive; commands can still change the
+// history underneath it, so it takes the lock too.
+
+// search starts a reverse search, or if we're in one, looks for an older
+// match
+func (self *commandLine) search(v *gocui.View) {
+	if !self.searching {
+		self.searching = true
+		self.query = ""
+		self.found = self.historyLen()
+		self.beforeSearch = strings.TrimRight(v.Buffer(), "\n")
+	}
+
+	self.findOlder(self.found - 1)
+	self.showSearch(v)
+}
+
+// findOlder moves to the most recent match at or before history[from]
+func (self *commandLine) findOlder(from int) {
+	self.historyLock.Lock()
+	defer self.historyLock.Unlock()
+
+	if from >= len(self.history) {
+		from = len(self.history) - 1
+	}
+
+	for i := from; i >= 0; i-- {
+		if strings.Contains(self.history[i], self.query) {
+			self.found = i
+			self.failed = false
+			return
+		}
+	}
+	self.failed = true
+}
+
+func (self *commandLine) match() string {
+	self.historyLock.Lock()
+	defer self.historyLock.Unlock()
+
+	if self.found < len(self.history) {
+		return self.history[self.found]
+	}
+	return ""
+}
+
+func (self *commandLine) showSearch(v *gocui.View) {
+	prompt := "(reverse-i-search)"
+	if self.failed {
+		prompt = "(failing reverse-i-search)"
+	}
+
+	text := fmt.Sprintf("%s`%s': %s", prompt, self.query, self.match())
+	v.Clear()
+	fmt.Fprintf(v, "%s", text)
+	v.SetCursor(len(prompt)+1+len(self.query), 0)
+}
+
+// endSearch leaves search, with line on the command line
+func (self *commandLine) endSearch(v *gocui.View, line string) {
+	self.searching = false
+	v.Clear()
+	fmt.Fprintf(v, "%s", line)
+	v.SetCursor(len(line), 0)
+}
+
+// searchEdit is the command line's editor while we're searching: typing
+// adds to what we're looking for
+func (self *commandLine) searchEdit(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+	switch {
+	case ch != 0 && mod == 0:
+		self.query += string(ch)
+	case key == gocui.KeySpace:
+		self.query += " "
+	case key == gocui.KeyBackspace || key == gocui.KeyBackspace2:
+		if self.query != "" {
+			self.query = self.query[:len(self.query)-1]
+		}
+		self.found = self.historyLen()
+	default:
+		self.endSearch(v, self.match())
+		return
+	}
+
+	// a longer query can still match what we're on
+	self.findOlder(self.found)
+	self.showSearch(v)
+}
+
+// searchKey gets keys with bindings first while we're searching; Enter
+// runs the match, Esc gives up, and anything else but another search keeps
+// the match to edit and then does what it normally does. It returns whether
+// it took care of the key.
+func (self *commandLine) searchKey(v *gocui.View, kv interface{}) bool {
+	cmdline, _ := g.View("cmdline")
+
+	switch kv {
+	case gocui.KeyEnter:
+		self.endSearch(cmdline, self.match())
+		return false
+	case gocui.KeyEsc:
+		self.endSearch(cmdline, self.beforeSearch)
+		return true
+	}
+
+	if b := lookupKey(keyName(kv)); b != nil && b.action == "history-search" {
+		return false
+	}
+
+	self.endSearch(cmdline, self.match())
+	return false
+}
+
+// cmdlineEditor is the command line's gocui editor
+func cmdlineEditor(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+	if CommandLine.searching {
+		CommandLine.searchEdit(v, key, ch, mod)
+		return
+	}
+
+	gocui.DefaultEditor.Edit(v, key, ch, mod)
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"io/ioutil"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jroimartin/gocui"
@@ -19,12 +19,36 @@ import (
 
 type commandLine struct {
 	c           chan event
+	historyLock sync.Mutex // history changes on the gocui goroutine too
 	history     []string
 	historyPos  int
 	savedLine   string
 	lastCommand string
 	macros      map[string]string
 	done        chan bool
+
+	// reverse search (see cmdhistory.go)
+	searching    bool
+	query        string
+	found        int
+	failed       bool
+	beforeSearch string
+
+	// Tab completion (see complete.go)
+	choices      []string
+	choice       int
+	choiceHead   string
+	choiceTail   string
+	lastComplete string
+
+	// macros (see macros.go)
+	fromFile  map[string]bool
+	macroMod  time.Time
+	defining  *macroDef
+	callDepth int
+
+	// files being sourced (see cmdfile.go)
+	sourceDepth int
 }
 
 func (self *commandLine) deliver(e event) {
@@ -35,170 +59,23 @@ func (self *commandLine) makechan() {
 	self.c = make(chan event)
 }
 
-const (
-	I8 = iota
-	I16
-	I32
-	S
-	R
-)
-
-var (
-	rxr8  = regexp.MustCompile("(r|read|x)/(8|b|byte)")
-	rxr16 = regexp.MustCompile("(r|read|x)/(16|w|word)")
-	rxrs  = regexp.MustCompile("(r|read|x)/(s|str|string)")
-	rxrm  = regexp.MustCompile("(r|read|x)/(m|mem|memory)")
-
-	rxtwi = regexp.MustCompile("@(r|$)([0-9]+):r?([0-9]+)")
-	rxtw  = regexp.MustCompile("(r|$)([0-9]+):r?([0-9]+)")
-	rxtri = regexp.MustCompile("@(r|$)([0-9]+)")
-	rxtr  = regexp.MustCompile("(r|$)([0-9]+)")
-	rxta  = regexp.MustCompile("@([0-9a-fA-F]+)")
-
-	rxrep = regexp.MustCompile("^([0-9]+)x\\s+")
-)
-
-func (self *commandLine) read(line string) {
-	terms := strings.Split(line, " ")
-	if len(terms) == 1 {
-		logf("can't parse %s", line)
-		return
-	}
-
-	kind := I8
-
-	if m := rxr8.FindStringSubmatch(terms[0]); m != nil {
-		kind = I8
-	} else if m := rxr16.FindStringSubmatch(terms[0]); m != nil {
-		kind = 16
-	} else if m := rxrs.FindStringSubmatch(terms[0]); m != nil {
-		kind = S
-	} else if m := rxrm.FindStringSubmatch(terms[0]); m != nil {
-		kind = R
-	}
-
-	wreg := -1
-	reg := -1
-	addr := uint64(0xffffff)
-	indir := false
-
-	if m := rxtwi.FindStringSubmatch(terms[1]); m != nil {
-		indir = true
-		wreg, _ = strconv.Atoi(m[2])
-		if wreg%2 != 0 {
-			wreg++
-		}
-
-		if wreg > 30 {
-			logf("can't parse reg:reg %s", terms[1])
-			return
-		}
-	} else if m := rxtw.FindStringSubmatch(terms[1]); m != nil {
-		wreg, _ = strconv.Atoi(m[2])
-		if wreg%2 != 0 {
-			wreg++
-		}
-
-		if wreg > 31 {
-			logf("can't parse reg:reg %s", terms[1])
-			return
-		}
-	} else if m := rxtri.FindStringSubmatch(terms[1]); m != nil {
-		indir = true
-		wreg, _ = strconv.Atoi(m[2])
-		if wreg%2 != 0 {
-			wreg++
-		}
-
-		if wreg > 31 {
-			logf("can't parse reg:reg %s", terms[1])
-			return
-		}
-	} else if m := rxtr.FindStringSubmatch(terms[1]); m != nil {
-		reg, _ = strconv.Atoi(m[2])
-		if reg > 31 {
-			logf("can't parse reg:reg %s", terms[1])
-			return
-		}
-	} else if m := rxta.FindStringSubmatch(terms[1]); m != nil {
-		addr, _ = strconv.ParseUint(m[1], 16, 16)
-		if addr > 0xffff {
-			logf("can't parse address: %s", terms[1])
-		}
-	}
-
-	if reg != -1 {
-		logf("r%d: %s", reg, CurrentStatus.stat.Cpu.Registers[reg])
-		return
-	}
-
-	if wreg != -1 {
-		val := CurrentStatus.stat.Cpu.Registers[wreg+1] + CurrentStatus.stat.Cpu.Registers[wreg]
-
-		if !indir {
-			logf("r%d:%d: %s", wreg, wreg+1, val)
-			return
-		}
-
-		addr, _ = strconv.ParseUint(val, 16, 16)
-	}
-
-	if addr > 0xffff {
-		logf("can't parse %s", terms[1])
-		return
-	}
-
-	var blob []byte
+var rxrep = regexp.MustCompile("^([0-9]+)x\\s+")
 
-	switch kind {
-	case I8:
-		if blob = peek(uint16(addr), 1); blob != nil {
-			logf("value at %0.4x: %0.2x", addr, blob[0])
-		} else {
-			logf("can't read %0.4x", addr)
-		}
-	case I16:
-		if blob = peek(uint16(addr), 2); blob != nil {
-			logf("value at %0.4x: %0.2x%0.2x", addr, blob[0], blob[1])
-		} else {
-			logf("can't read %0.4x", addr)
-		}
-	case S:
-		if blob = peek(uint16(addr), 128); blob != nil {
-			off := bytes.Index(blob, []byte("\x00"))
-			if off != -1 {
-				blob = blob[0:off]
-			}
-
-			for i := 0; i < len(blob); i++ {
-				if blob[i] < 32 || blob[i] > 126 {
-					blob[i] = '?'
-				}
-			}
-
-			logf("value at %0.4x: %s", addr, string(blob))
-		} else {
-			logf("can't read %0.4x", addr)
-		}
-	case R:
-		if blob = peek(uint16(addr), 32); blob != nil {
-			out := &bytes.Buffer{}
-			for _, b := range blob {
-				fmt.Fprintf(out, "%0.2x", b)
-			}
-
-			logf("value at %0.4x: %s", addr, out.String())
-		} else {
-			logf("can't read %0.4x", addr)
-		}
+// parse runs a line of commands, returning false if one of them failed, so
+// a macro or command file running it can stop
+func (self *commandLine) parse(line string) bool {
+	if self.defining != nil {
+		self.capture(line)
+		return true
 	}
-}
 
-func (self *commandLine) parse(line string) {
-	if macro, ok := self.macros[strings.Trim(line, " \t")]; ok {
-		logf("executing %s", macro)
-		self.parse(macro)
-		return
+	// the semicolons in "define name: body" are the body's, and if/while/
+	// repeat work at the command line too
+	switch word, _ := firstWord(line); {
+	case word == "define":
+		return self.parseTerm(strings.TrimSpace(line))
+	case blockDelta(word) > 0:
+		return self.exec(splitStatements(line), &macroEnv{})
 	}
 
 	for _, term := range strings.Split(line, ";") {
@@ -209,17 +86,28 @@ func (self *commandLine) parse(line string) {
 			term = strings.Trim(term[len(m[1])+2:], " \t")
 		}
 
-		if !self.parseTerm(term) {
-			logf("bad command '%s'", term)
-			break
+		run := self.parseTerm
+		if term == "" {
+			term = self.lastCommand
+		}
+		if name, rest := firstWord(term); self.isMacro(name) {
+			run = func(string) bool { return self.call(name, strings.Fields(rest)) }
+		}
+
+		if !run(term) {
+			return false
 		} else if term != "" {
 			self.lastCommand = term
 		}
 
 		for i := 0; i < repeat-1; i++ {
-			self.parseTerm(term)
+			if !run(term) {
+				return false
+			}
 		}
 	}
+
+	return true
 }
 
 func (self *commandLine) parseTerm(line string) (success bool) {
@@ -234,19 +122,34 @@ func (self *commandLine) parseTerm(line string) (success bool) {
 		fallthrough
 	case strings.HasPrefix(line, "r/"):
 		fallthrough
-	case strings.HasPrefix(line, "x/"):
-		self.read(line)
+	case strings.HasPrefix(line, "x/"), line == "x", strings.HasPrefix(line, "x "):
+		success = examine(line)
 		redraw()
 		return
+	case strings.HasPrefix(line, "print/"):
+		fallthrough
+	case strings.HasPrefix(line, "p/"):
+		toks := strings.SplitN(line, " ", 2)
+		f := toks[0][strings.Index(toks[0], "/")+1:]
+		if len(toks) < 2 || len(f) != 1 || !strings.Contains("xduct", f) {
+			logf("print[/x|/d|/u|/c|/t] <expr>")
+			return false
+		}
+		return printExpr(toks[1], f[0])
 	}
 
 	toks := strings.Split(line, " ")
 	switch toks[0] {
 	case "wait":
+		if len(toks) < 2 {
+			logf("wait <duration>")
+			return false
+		}
 		if duration, err := time.ParseDuration(toks[1]); err == nil {
 			time.Sleep(duration)
 		} else {
 			logf("bad duration: %s", err)
+			success = false
 		}
 	case "clr", "cls":
 		Log.deliver(event{kind: CLEAR})
@@ -262,20 +165,127 @@ func (self *commandLine) parseTerm(line string) (success bool) {
 		Stack.deliver(event{kind: STACK_BUMP})
 	case "dump":
 		if len(toks) > 1 {
-			addr, _ := strconv.ParseUint(toks[1], 16, 16)
+			switch toks[1] {
+			case "follow":
+				Dump.deliver(event{kind: DUMP_FOLLOW})
+				return
+			case "back":
+				Dump.deliver(event{kind: DUMP_BACK})
+				return
+			case "as":
+				name := strings.Join(toks[2:], " ")
+				if name == "hex" || name == "off" {
+					name = ""
+				} else if _, err := parseTypeName(name); err != nil {
+					logf("dump as <type|hex>: %s", err)
+					return false
+				}
+				onGui(func() { Tabbar.switchTo("dump") })
+				Dump.deliver(event{kind: DUMP_AS, data: name})
+				return
+			case "group":
+				n := 0
+				if len(toks) > 2 {
+					n, _ = strconv.Atoi(toks[2])
+				}
+				if n != 1 && n != 2 && n != 4 {
+					logf("dump group <1|2|4>")
+					return false
+				}
+				Dump.deliver(event{kind: DUMP_GROUP, addr: n})
+				return
+			}
+
+			var addr int
 
 			if toks[1] == "stack" || toks[1] == "sp" {
-				addr, _ = strconv.ParseUint(CurrentStatus.stat.Cpu.Sp, 16, 16)
+				addr = int(CurrentStatus.stat.Cpu.sp())
 				if addr > (16 * 8) {
 					addr -= (16 * 8)
 				} else {
 					addr = 0
 				}
+			} else {
+				var err error
+				if addr, err = locate(strings.Join(toks[1:], ""), dataLoc); err != nil {
+					logf("%s", err)
+					return false
+				}
 			}
 
-			Dump.deliver(event{kind: FETCH, addr: int(addr)})
+			Dump.deliver(event{kind: FETCH, addr: addr})
 		}
 
+	case "goto":
+		if len(toks) > 1 {
+			addr, err := locate(strings.Join(toks[1:], ""), dataLoc)
+			if err != nil {
+				logf("%s", err)
+				return false
+			}
+			onGui(func() { Tabbar.switchTo("dump") })
+			Dump.deliver(event{kind: DUMP_GOTO, addr: addr})
+		}
+	case "display":
+		if len(toks) > 1 {
+			Watches.add(strings.Join(toks[1:], " "))
+		} else {
+			Watches.list()
+		}
+	case "undisplay":
+		if len(toks) > 1 {
+			n := -1
+			if toks[1] != "all" {
+				var err error
+				if n, err = strconv.Atoi(toks[1]); err != nil {
+					logf("undisplay <n|all>")
+					return false
+				}
+			}
+			Watches.remove(n)
+		} else {
+			logf("undisplay <n|all>")
+			success = false
+		}
+	case "types":
+		return typesCommand(toks)
+	case "ptype":
+		if len(toks) < 2 {
+			logf("ptype <type|expr>")
+			return false
+		}
+		return ptype(strings.Join(toks[1:], " "))
+	case "find":
+		return findCommand(toks)
+	case "snapshot", "snap":
+		return snapshotCommand(toks)
+	case "theme":
+		return themeCommand(toks)
+	case "keys", "bind", "unbind":
+		return keysCommand(toks, line)
+	case "split", "unsplit", "only", "pane":
+		return paneCommand(toks)
+	case "layout":
+		return layoutCommand(toks)
+	case "define", "macros", "macro":
+		return self.macroCommand(toks, line)
+	case "source":
+		return self.sourceCommand(line)
+	case "output":
+		return outputCommand(toks)
+	case "history":
+		n := 20
+		if len(toks) > 1 && toks[1] == "clear" {
+			self.clearHistory()
+			return
+		} else if len(toks) > 1 {
+			var err error
+			if n, err = strconv.Atoi(toks[1]); err != nil || n < 1 {
+				logf("history [n|clear]")
+				return false
+			}
+		}
+		self.showHistory(n)
 	case "compile":
 		Source.deliver(event{kind: COMPILE, done: &self.done})
 		<-self.done
@@ -292,11 +302,15 @@ func (self *commandLine) parseTerm(line string) (success bool) {
 				Log.deliver(event{kind: SAVE, data: toks[2]})
 			case "output":
 				Output.deliver(event{kind: SAVE, data: toks[2]})
+			case "trace":
+				Trace.deliver(event{kind: SAVE, data: toks[2]})
 			default:
 				logf("don't know how to save '%s'", toks[1])
+				success = false
 			}
 		} else {
 			logf("save [thing to save] [logfile]")
+			success = false
 		}
 
 	case "functions":
@@ -335,107 +349,251 @@ func (self *commandLine) parseTerm(line string) (success bool) {
 
 	case "uptime":
 		res, err := Session.get("/uptime")
-		if res.HTTPOK(err) {
-			logf(string(res.body))
+		if !res.HTTPOK(err) {
+			return false
 		}
+		logf(string(res.body))
 
 	case "select":
 		if len(toks) > 1 {
 			level, _ := strconv.Atoi(toks[1])
 			res, err := Session.post("/select", fmt.Sprintf("{\"level\":%d}", level))
-			if res.HTTPOK(err) {
-				logf("selected level %d", level)
+			if !res.HTTPOK(err) {
+				return false
 			}
+			logf("selected level %d", level)
 		}
 
 	case "runto", "rt":
 		if len(toks) > 1 {
-			addr, _ := strconv.ParseUint(toks[1], 16, 16)
-			res, err := Session.post(fmt.Sprintf("/device/runto/%d", addr), "")
-			if res.HTTPOK(err) {
-				logf("running to %0.4x", addr)
+			addr, err := locate(strings.Join(toks[1:], ""), codeLoc)
+			if err != nil {
+				logf("%s", err)
+				return false
 			}
+			return runTo(addr)
+		}
+	case "stepover", "next", "n":
+		return stepOver()
+	case "finish", "fin":
+		return finish()
+	case "until", "u":
+		if len(toks) > 1 {
+			addr, err := locate(strings.Join(toks[1:], ""), codeLoc)
+			if err != nil {
+				logf("%s", err)
+				return false
+			}
+			return until(addr)
 		}
 	case "break", "b":
 		if len(toks) > 1 {
-			addr, err := strconv.ParseUint(toks[1], 16, 16)
+			addr, err := locate(strings.Join(toks[1:], ""), codeLoc)
 			if err != nil {
-				addr = uint64(Listing.symdex[toks[1]])
-				if addr == 0 {
-					logf("no symbol matching %s", toks[1])
-					return
-				}
+				logf("%s", err)
+				return false
 			}
 
 			res, err := Session.put(fmt.Sprintf("/device/breakpoints/%d", addr), "")
-			if res.HTTPOK(err) {
-				logf("breakpoint added at %0.4x", addr)
-				Listing.deliver(event{kind: REFRESH_BPS})
-				updateStatus()
+			if !res.HTTPOK(err) {
+				return false
 			}
+			keepBreakpoint(uint16(addr))
+			logf("breakpoint added at %0.4x", addr)
+			Listing.deliver(event{kind: REFRESH_BPS})
+			updateStatus()
 		}
 	case "clear":
 		if len(toks) > 1 {
-			addr, err := strconv.ParseUint(toks[1], 16, 16)
+			addr, err := locate(strings.Join(toks[1:], ""), codeLoc)
 			if err != nil {
-				addr = uint64(Listing.symdex[toks[1]])
-				if addr == 0 {
-					logf("no symbol matching %s", toks[1])
-					return
-				}
+				logf("%s", err)
+				return false
 			}
 
 			res, err := Session.del(fmt.Sprintf("/device/breakpoints/%d", addr))
-			if res.HTTPOK(err) {
-				logf("cleared all breakpoints at %0.4x", addr)
-				Listing.deliver(event{kind: REFRESH_BPS})
-				updateStatus()
+			if !res.HTTPOK(err) {
+				return false
+			}
+			logf("cleared all breakpoints at %0.4x", addr)
+			Listing.deliver(event{kind: REFRESH_BPS})
+			updateStatus()
+		}
+	case "watch", "rwatch", "awatch":
+		if len(toks) > 1 {
+			addr, err := locate(toks[1], dataLoc)
+			if err != nil {
+				logf("%s", err)
+				return false
 			}
+
+			size := 1
+			if len(toks) > 2 {
+				if size, err = strconv.Atoi(toks[2]); err != nil {
+					logf("can't parse length: %s", toks[2])
+					return false
+				}
+			}
+
+			Watcher.add(uint16(addr), size, toks[0] != "watch", toks[0] != "rwatch")
+		} else {
+			logf("%s <addr> [len]", toks[0])
+			success = false
 		}
+	case "unwatch":
+		if len(toks) > 1 {
+			n := -1
+			if toks[1] != "all" {
+				var err error
+				if n, err = strconv.Atoi(toks[1]); err != nil || n < 0 {
+					logf("unwatch <n|all>")
+					return false
+				}
+			}
+
+			if Watcher.remove(n) {
+				logf("removed watchpoint %s", toks[1])
+			} else {
+				logf("no watchpoint %s", toks[1])
+				success = false
+			}
+		} else {
+			logf("unwatch <n|all>")
+			success = false
+		}
+	case "trace":
+		if len(toks) < 2 {
+			on, count := Trace.tracing()
+			logf("tracing: %t, %d states recorded", on, count)
+			return
+		}
+
+		switch toks[1] {
+		case "start":
+			Trace.start()
+		case "stop":
+			Trace.stop()
+		case "size":
+			n := 0
+			if len(toks) > 2 {
+				n, _ = strconv.Atoi(toks[2])
+			}
+			if n < 1 {
+				logf("trace size <n>; n is how many states to keep (default %d)", traceSize)
+				return false
+			}
+			Trace.resize(n)
+		case "save":
+			if len(toks) < 3 {
+				logf("trace save <file>")
+				return false
+			}
+			Trace.deliver(event{kind: SAVE, data: toks[2]})
+		default:
+			logf("trace start|stop|size <n>|save <file>")
+			success = false
+		}
+	case "rstep", "rs":
+		n := 1
+		if len(toks) > 1 {
+			var err error
+			if n, err = strconv.Atoi(toks[1]); err != nil || n < 1 {
+				logf("rstep [n]")
+				return false
+			}
+		}
+		History.back(n)
+	case "rcontinue", "rc":
+		History.rcontinue()
+	case "goto-history":
+		if len(toks) > 1 {
+			if toks[1] == "live" {
+				History.live()
+			} else if n, err := strconv.Atoi(toks[1]); err == nil {
+				History.goTo(n)
+			} else {
+				logf("goto-history <n|live>")
+				success = false
+			}
+		} else {
+			logf("goto-history <n|live>")
+			success = false
+		}
+	case "bt", "backtrace", "where":
+		printBacktrace(len(toks) > 1 && (toks[1] == "fp" || toks[1] == "y"))
+	case "watchpoints":
+		Watcher.list()
+	case "print", "p":
+		return printExpr(strings.Join(toks[1:], " "), 0)
 	case "echo":
 		if len(toks) > 1 {
 			logf("%s", strings.Join(toks[1:], " "))
 		}
 		return
 	case "restart":
+		History.live()
 		res, err := Session.post("/device/restart", "")
-		if res.OK(err) {
-			logf("restarting device")
-			updateStatus()
+		if !res.OK(err) {
+			return false
 		}
+		logf("restarting device")
+		updateStatus()
 	case "continue", "cont", "c":
+		History.live()
+		checkTempBreakpoints()
+
+		if Watcher.isRunning() {
+			logf("already single-stepping for watchpoints")
+			return
+		}
+
+		if Watcher.active() {
+			Watcher.deliver(event{kind: WATCH_RUN, addr: -1})
+			return
+		}
+
 		res, err := Session.post("/device/continue", "")
-		if res.OK(err) {
-			updateStatus()
+		if !res.OK(err) {
+			return false
 		}
+		updateStatus()
 	case "step", "s":
+		if Watcher.isRunning() {
+			Watcher.cancel()
+			return
+		}
+
+		History.live()
+		checkTempBreakpoints()
+
 		res, err := Session.post("/device/step", "")
-		if res.OK(err) {
-			updateStatus()
+		if !res.OK(err) {
+			return false
 		}
+		updateStatus()
 	case "start":
+		History.live()
 		Listing.notFollowing = false
 		res, err := Session.post("/device/start", "")
-		if res.OK(err) {
-			logf("started device")
-			updateStatus()
+		if !res.OK(err) {
+			return false
 		}
+		logf("started device")
+		updateStatus()
 	case "update":
 		updateStatus()
 	case "list", "l":
 		if len(toks) > 1 {
-			addr, err := strconv.ParseUint(toks[1], 16, 16)
+			addr, err := locate(strings.Join(toks[1:], ""), codeLoc)
 			if err != nil {
-				addr = uint64(Listing.symdex[toks[1]])
-				if addr == 0 {
-					logf("no symbol matching %s", toks[1])
-					return
-				}
+				logf("%s", err)
+				return false
 			}
-			Listing.deliver(event{kind: LIST_ADDR, addr: int(addr)})
+			Listing.deliver(event{kind: LIST_ADDR, addr: addr})
 		}
 		return
 	default:
+		logf("bad command '%s'", line)
 		success = false
 	}
 
@@ -444,17 +602,24 @@ func (self *commandLine) parseTerm(line string) (success bool) {
 
 func (self *commandLine) flush() {
 	withViewNamed("cmdline", func(v *gocui.View) {
-		line := strings.Trim(v.Buffer(), " \t\n")
-		self.history = append(self.history, line)
-		self.historyPos = len(self.history) - 1
+		typed := strings.Trim(v.Buffer(), " \t\n")
 		v.Clear()
+
+		line, err := self.expandHistory(typed)
+		if err != nil {
+			logf("%s", err)
+			return
+		}
+		if line != typed {
+			logf("%s", line)
+		}
+
+		self.addHistory(line)
 		self.parse(line)
 	})
 }
 
-func (self *commandLine) fromHistory() {
-	line := self.history[self.historyPos]
-
+func (self *commandLine) fromHistory(line string) {
 	//withViewNamed( "cmdline", func(v *gocui.View) {
 	// 	v.Clear()
 	//})
@@ -465,30 +630,16 @@ func (self *commandLine) fromHistory() {
 	})
 }
 
-func (self *commandLine) loadMacros(file string) {
-	if self.macros == nil {
-		self.macros = map[string]string{}
-
-		buf, err := ioutil.ReadFile(file)
-		if err != nil {
-			logf("couldn't open \"%s\"; macros not loaded", file)
-			return
-		}
-
-		for _, macro := range strings.Split(string(buf), "\n") {
-			tups := strings.SplitN(macro, ":", 2)
-			if len(tups) != 2 {
-				continue
-			}
-
-			self.macros[strings.Trim(tups[0], " \t")] = strings.Trim(tups[1], " \t")
-		}
-	}
-}
-
 func (self *commandLine) init() {
+	self.loadHistory()
+
 	if self.macros == nil {
-		self.loadMacros("macros.cmd")
+		if err := self.loadMacros(macroFile); os.IsNotExist(err) {
+			logf("couldn't open \"%s\"; macros not loaded", macroFile)
+		} else if err != nil {
+			logf("%s", err)
+		}
+		go self.watchMacros(macroFile)
 	}
 
 	if self.done == nil {
@@ -505,20 +656,12 @@ func (self *commandLine) loop() {
 		case FLUSH:
 			self.flush()
 		case HIST_UP:
-			if len(self.history) > 0 {
-				self.historyPos -= 1
-				if self.historyPos < 0 {
-					self.historyPos = 0
-				}
-				self.fromHistory()
+			if line, ok := self.moveHistory(-1); ok {
+				self.fromHistory(line)
 			}
 		case HIST_DOWN:
-			if len(self.history) > 0 {
-				self.historyPos += 1
-				if self.historyPos >= len(self.history) {
-					self.historyPos = len(self.history) - 1
-				}
-				self.fromHistory()
+			if line, ok := self.moveHistory(1); ok {
+				self.fromHistory(line)
 			}
 		case MODE_IN:
 			v, _ := g.View("cmdline")
@@ -533,6 +676,17 @@ func (self *commandLine) loop() {
 			v.Editable = true
 		case COMMAND:
 			self.parse(event.data)
+		case COMPLETE:
+			self.complete(event.data, event.addr)
+		case RELOAD_MACROS:
+			if int(self.macroMod.Unix()) == event.addr {
+				break
+			}
+			if err := self.loadMacros(event.data); err != nil {
+				logf("%s", err)
+			} else {
+				logf("reloaded %s", event.data)
+			}
 		}
 
 		redraw()
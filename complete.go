@@ -0,0 +1,298 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+)
+
+// Tab completion. Tab on a command line with something on it completes the
+// word that ends at the cursor as far as it can, leaving whatever's after
+// the cursor where it is; if that's ambiguous, the
+// candidates go to the log, and more Tabs cycle through them. What counts
+// as a candidate depends on the command: symbols for the ones that take
+// code addresses, registers and symbols for expressions, file names for
+// the ones that load and save.
+
+// commandNames are what we complete the first word to (besides macros)
+var commandNames = []string{
+	"awatch", "backtrace", "bind", "break", "breakpoints", "bt", "bump",
+	"clear", "clr", "cls", "compile", "cont", "continue", "define",
+	"display", "dump", "echo", "find", "finish", "flash", "follow",
+	"functions", "goto", "goto-history", "history", "keys", "layout",
+	"list", "load", "macro", "macros", "next", "nofollow", "only",
+	"output", "pane", "print", "ptype", "rcontinue", "restart", "rstep",
+	"runto", "rwatch", "save", "select", "snapshot", "source", "split",
+	"start", "step", "stepover", "theme", "trace", "types", "unbind",
+	"undisplay", "unsplit", "until", "unwatch", "update", "uptime",
+	"vmexec", "vmload", "wait", "watch", "watchpoints", "where", "x",
+}
+
+// commandAliases are the short names, which we don't complete to but which
+// are commands all the same
+var commandAliases = []string{
+	"b", "c", "fin", "l", "n", "p", "rc", "rs", "rt", "s", "snap", "u",
+}
+
+// isCommand is true if name is a built-in command, which macros can't
+// be named
+func isCommand(name string) bool {
+	for _, names := range [][]string{commandNames, commandAliases} {
+		for _, cmd := range names {
+			if name == cmd {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// completers say what an argument of a command can be; the first word of
+// the line picks one
+var completers = map[string]func(args []string) []string{}
+
+// inExpr are the commands whose arguments are expressions or locations,
+// where we complete the name at the end of the argument rather than all of
+// it (so "p r24+fo" completes "fo")
+var inExpr = map[string]bool{}
+
+func init() {
+	for _, cmd := range []string{"break", "b", "clear", "list", "l", "runto", "rt", "until", "u"} {
+		completers[cmd] = completeSymbols
+		inExpr[cmd] = true
+	}
+
+	for _, cmd := range []string{"print", "p", "display", "x", "goto", "dump", "watch", "rwatch", "awatch", "find"} {
+		completers[cmd] = completeExpr
+		inExpr[cmd] = true
+	}
+
+	completers["load"] = completeFiles
+	completers["source"] = completeFiles
+	completers["save"] = func(args []string) []string {
+		if len(args) == 1 {
+			return []string{"log", "output", "trace"}
+		}
+		return completeFiles(args)
+	}
+
+	// "types load <file>" and the like
+	for _, cmd := range []string{"types", "theme", "keys"} {
+		completers[cmd] = func(args []string) []string {
+			if len(args) == 2 && args[0] == "load" {
+				return completeFiles(args)
+			}
+			return nil
+		}
+	}
+
+	completers["macro"] = func(args []string) []string {
+		if len(args) == 1 {
+			return []string{"show", "edit", "del", "save", "reload"}
+		}
+		if args[0] == "save" {
+			return completeFiles(args)
+		}
+		return completeMacros()
+	}
+
+	completers["output"] = func(args []string) []string { return outputModes }
+
+	completers["split"] = func(args []string) []string { return Tabbar.options }
+	completers["layout"] = func(args []string) []string {
+		names := []string{"rows", "cols", "listing", "save", "del"}
+		for name := range builtinLayouts {
+			names = append(names, name)
+		}
+		for name := range layouts {
+			names = append(names, name)
+		}
+		return names
+	}
+}
+
+func completeMacros() []string {
+	names := []string{}
+	for name := range CommandLine.macros {
+		names = append(names, name)
+	}
+	return names
+}
+
+func completeSymbols(args []string) []string {
+	syms := []string{}
+	for sym := range Listing.symdex {
+		syms = append(syms, sym)
+	}
+	return syms
+}
+
+func completeExpr(args []string) []string {
+	names := []string{"X", "Y", "Z", "SP", "PC", "SREG"}
+	for r := 0; r < 32; r++ {
+		names = append(names, "r"+strconv.Itoa(r))
+	}
+	return append(names, completeSymbols(args)...)
+}
+
+// completeFiles lists what's in the directory the last argument names
+func completeFiles(args []string) []string {
+	word := args[len(args)-1]
+	dir, base := filepath.Split(word)
+
+	infos, err := ioutil.ReadDir(dir + ".")
+	if err != nil {
+		return nil
+	}
+
+	files := []string{}
+	for _, fi := range infos {
+		name := fi.Name()
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+		if fi.IsDir() {
+			name += "/"
+		}
+		files = append(files, dir+name)
+	}
+	return files
+}
+
+// exprWord is true for the bytes that can be in a register or symbol
+func exprWord(c byte) bool {
+	return c == '_' || c == '$' || c == '.' || (c >= '0' && c <= '9') ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// candidates splits line into what stays and the word being completed,
+// and returns the possibilities for that word
+func (self *commandLine) candidates(line string) (head, word string, cands []string) {
+	// only the last of several ;-separated commands
+	start := strings.LastIndex(line, ";") + 1
+	for start < len(line) && line[start] == ' ' {
+		start++
+	}
+
+	toks := strings.Split(line[start:], " ")
+
+	cmd := toks[0]
+	if i := strings.Index(cmd, "/"); i != -1 {
+		cmd = cmd[:i] // x/4x, p/x
+	}
+
+	var all []string
+	if len(toks) == 1 {
+		all = append(all, commandNames...)
+		for name := range self.macros {
+			all = append(all, name)
+		}
+	} else if complete, ok := completers[cmd]; ok {
+		all = complete(toks[1:])
+	}
+
+	word = toks[len(toks)-1]
+
+	if len(toks) > 1 && inExpr[cmd] {
+		i := len(word)
+		for i > 0 && exprWord(word[i-1]) {
+			i--
+		}
+		word = word[i:]
+	}
+
+	head = line[:len(line)-len(word)]
+
+	seen := map[string]bool{}
+	for _, c := range all {
+		if strings.HasPrefix(c, word) && !seen[c] {
+			seen[c] = true
+			cands = append(cands, c)
+		}
+	}
+	sort.Strings(cands)
+
+	return
+}
+
+// commonPrefix is the longest prefix all of cands share
+func commonPrefix(cands []string) string {
+	prefix := cands[0]
+	for _, c := range cands[1:] {
+		for !strings.HasPrefix(c, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// complete handles Tab on the command line, which has line on it with the
+// cursor at column at
+func (self *commandLine) complete(line string, at int) {
+	if at > len(line) {
+		at = len(line)
+	}
+	tail := line[at:]
+
+	// another Tab right after an ambiguous one cycles through the choices
+	if len(self.choices) > 0 && line == self.lastComplete {
+		self.choice = (self.choice + 1) % len(self.choices)
+		self.setLineAt(self.choiceHead+self.choices[self.choice], self.choiceTail)
+		return
+	}
+	self.choices = nil
+
+	head, word, cands := self.candidates(line[:at])
+
+	switch {
+	case len(cands) == 0:
+		return
+
+	case len(cands) == 1:
+		done := head + cands[0]
+		if !strings.HasSuffix(done, "/") && !strings.HasPrefix(tail, " ") {
+			done += " "
+		}
+		self.setLineAt(done, tail)
+
+	default:
+		prefix := commonPrefix(cands)
+		if prefix == word {
+			self.choices, self.choice = cands, -1
+			self.choiceHead, self.choiceTail = head, tail
+		}
+
+		shown := cands
+		if len(shown) > 20 {
+			shown = shown[:20]
+		}
+		more := ""
+		if len(cands) > len(shown) {
+			more = " ..."
+		}
+		logf("%s%s", strings.Join(shown, "  "), more)
+
+		self.setLineAt(head+prefix, tail)
+	}
+}
+
+// setLine puts text on the command line with the cursor at the end
+func (self *commandLine) setLine(text string) {
+	self.setLineAt(text, "")
+}
+
+// setLineAt puts text and then tail on the command line, with the cursor
+// between them
+func (self *commandLine) setLineAt(text, tail string) {
+	self.lastComplete = text + tail
+
+	withViewNamed("cmdline", func(v *gocui.View) {
+		v.Clear()
+		v.Write([]byte(text + tail))
+		v.SetCursor(len(text), 0)
+	})
+}
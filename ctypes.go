@@ -0,0 +1,713 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// C types, so memory can be looked at as the structs the firmware uses.
+// "types load <file>" reads a header of struct, union and typedef
+// declarations; after that, the types work in expressions ("print *(struct
+// account *)0x240", "ptype struct account") and in the memory view ("dump as
+// struct account").
+//
+// This isn't a C compiler. It understands the integer types, char, float,
+// pointers, arrays, and structs and unions made of those, laid out the way
+// avr-gcc does it: no padding, 2-byte pointers, 2-byte int. It doesn't do
+// enums, bitfields, or function pointers.
+
+type typeKind int
+
+const (
+	scalarKind typeKind = iota
+	floatKind
+	pointerKind
+	arrayKind
+	structKind
+	unionKind
+)
+
+// field is a member of a struct or union
+type field struct {
+	name string
+	typ  *ctype
+	off  int
+}
+
+// aggregate is true for types whose values live in memory, so the value of
+// one in an expression is its address
+func (self *ctype) aggregate() bool {
+	return self.kind == arrayKind || self.kind == structKind || self.kind == unionKind
+}
+
+// isChar is true for the types we print as text in arrays
+func (self *ctype) isChar() bool {
+	return self.kind == scalarKind && self.size == 1 && strings.HasSuffix(self.name, "char")
+}
+
+// declare renders a declaration of name as a t, C style
+func declare(t *ctype, name string) string {
+	switch t.kind {
+	case pointerKind:
+		return declare(t.elem, "*"+name)
+	case arrayKind:
+		return declare(t.elem, fmt.Sprintf("%s[%d]", name, t.count))
+	}
+
+	if name == "" {
+		return t.name
+	}
+
+	return t.name + " " + name
+}
+
+func typeName(t *ctype) string {
+	return strings.TrimSpace(declare(t, ""))
+}
+
+func pointerTo(t *ctype) *ctype {
+	return &ctype{size: 2, kind: pointerKind, elem: t}
+}
+
+func arrayOf(t *ctype, n int) *ctype {
+	return &ctype{size: t.size * n, kind: arrayKind, elem: t, count: n}
+}
+
+// cTypes are the built-in C types, sized for avr-gcc
+var cTypes = map[string]*ctype{
+	"void":     {name: "void"},
+	"char":     {name: "char", size: 1, signed: true},
+	"int8_t":   {name: "int8_t", size: 1, signed: true},
+	"uint8_t":  {name: "uint8_t", size: 1},
+	"int16_t":  {name: "int16_t", size: 2, signed: true},
+	"uint16_t": {name: "uint16_t", size: 2},
+	"int32_t":  {name: "int32_t", size: 4, signed: true},
+	"uint32_t": {name: "uint32_t", size: 4},
+	"bool":     {name: "bool", size: 1},
+	"_Bool":    {name: "_Bool", size: 1},
+	"float":    {name: "float", size: 4, kind: floatKind},
+	"double":   {name: "double", size: 4, kind: floatKind},
+
+	"signed char":        {name: "signed char", size: 1, signed: true},
+	"unsigned char":      {name: "unsigned char", size: 1},
+	"short":              {name: "short", size: 2, signed: true},
+	"short int":          {name: "short", size: 2, signed: true},
+	"unsigned short":     {name: "unsigned short", size: 2},
+	"unsigned short int": {name: "unsigned short", size: 2},
+	"int":                {name: "int", size: 2, signed: true},
+	"signed":             {name: "int", size: 2, signed: true},
+	"signed int":         {name: "int", size: 2, signed: true},
+	"unsigned":           {name: "unsigned int", size: 2},
+	"unsigned int":       {name: "unsigned int", size: 2},
+	"long":               {name: "long", size: 4, signed: true},
+	"long int":           {name: "long", size: 4, signed: true},
+	"unsigned long":      {name: "unsigned long", size: 4},
+	"unsigned long int":  {name: "unsigned long", size: 4},
+}
+
+// userTypes are the ones we've loaded, keyed by "struct foo", "union bar",
+// or a typedef name
+var userTypes = map[string]*ctype{}
+
+// lookupType finds a type by name: ours, C's, or a loaded one
+func lookupType(name string) (*ctype, bool) {
+	return findType(userTypes, name)
+}
+
+// findType is lookupType with types standing in for the loaded ones
+func findType(types map[string]*ctype, name string) (*ctype, bool) {
+	if t, ok := scalarTypes[name]; ok {
+		return t, true
+	}
+
+	if t, ok := cTypes[name]; ok {
+		return t, true
+	}
+
+	t, ok := types[name]
+	return t, ok
+}
+
+// parseTypeName parses something like "struct account *" or "uint8_t[4]"
+func parseTypeName(src string) (*ctype, error) {
+	p := &headerParser{toks: cTokens(src), types: userTypes}
+
+	base, err := p.base()
+	if err != nil {
+		return nil, err
+	}
+
+	t, name, err := p.declarator(base)
+	if err != nil {
+		return nil, err
+	}
+
+	if name != "" || !p.eof() {
+		return nil, fmt.Errorf("'%s' isn't a type name", src)
+	}
+
+	return t, nil
+}
+
+// cTokens splits C source into identifiers, numbers and punctuation,
+// dropping comments and preprocessor lines
+func cTokens(src string) (toks []string) {
+	lines := []string{}
+	for _, l := range strings.Split(src, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(l), "#") {
+			lines = append(lines, l)
+		}
+	}
+	src = strings.Join(lines, "\n")
+
+	isWord := func(c byte) bool {
+		return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+	}
+
+	for i := 0; i < len(src); {
+		switch {
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end == -1 {
+				return
+			}
+			i += end + 4
+		case isWord(src[i]):
+			j := i
+			for j < len(src) && isWord(src[j]) {
+				j++
+			}
+			toks = append(toks, src[i:j])
+			i = j
+		case src[i] <= ' ':
+			i++
+		default:
+			toks = append(toks, src[i:i+1])
+			i++
+		}
+	}
+
+	return
+}
+
+type headerParser struct {
+	toks    []string
+	pos     int
+	loading bool // reading a header, rather than a type name in a command
+
+	// the types we know, which while loading is a copy of userTypes we
+	// only keep if the whole header is good
+	types map[string]*ctype
+
+	// made is the structs and unions this header made; completes is the
+	// ones that were already declared without a body, and their names, so
+	// they can get the body it gives them if the header's types are kept
+	made      map[*ctype]bool
+	completes map[*ctype]string
+}
+
+func (self *headerParser) eof() bool {
+	return self.pos >= len(self.toks)
+}
+
+func (self *headerParser) peek() string {
+	if self.eof() {
+		return ""
+	}
+	return self.toks[self.pos]
+}
+
+func (self *headerParser) next() string {
+	t := self.peek()
+	self.pos++
+	return t
+}
+
+func (self *headerParser) accept(tok string) bool {
+	if self.peek() == tok {
+		self.pos++
+		return true
+	}
+	return false
+}
+
+func (self *headerParser) expect(tok string) error {
+	if !self.accept(tok) {
+		return fmt.Errorf("expected '%s', got '%s'", tok, self.peek())
+	}
+	return nil
+}
+
+// the words that make up C's built-in type names, like "unsigned long int"
+var typeWords = map[string]bool{
+	"unsigned": true, "signed": true, "char": true, "short": true,
+	"int": true, "long": true, "float": true, "double": true,
+}
+
+// base parses the type part of a declaration, defining a struct or union
+// if there's a body
+func (self *headerParser) base() (*ctype, error) {
+	for self.accept("const") || self.accept("volatile") || self.accept("static") || self.accept("extern") || self.accept("inline") {
+	}
+
+	tok := self.peek()
+
+	if tok == "struct" || tok == "union" {
+		self.next()
+		return self.record(tok)
+	}
+
+	if typeWords[tok] {
+		words := []string{}
+		for typeWords[self.peek()] {
+			words = append(words, self.next())
+		}
+
+		t, ok := cTypes[strings.Join(words, " ")]
+		if !ok {
+			return nil, fmt.Errorf("unsupported type '%s'", strings.Join(words, " "))
+		}
+		return t, nil
+	}
+
+	if t, ok := findType(self.types, tok); ok {
+		self.next()
+		return t, nil
+	}
+
+	return nil, fmt.Errorf("unknown type '%s'", tok)
+}
+
+// record parses the rest of a struct or union, after the keyword
+func (self *headerParser) record(keyword string) (*ctype, error) {
+	kind := structKind
+	if keyword == "union" {
+		kind = unionKind
+	}
+
+	name := ""
+	if tok := self.peek(); tok != "{" {
+		name = keyword + " " + self.next()
+	}
+
+	t, ok := self.types[name]
+	if !ok && !self.loading {
+		return nil, fmt.Errorf("no %s", name)
+	}
+
+	if !ok {
+		t = self.fresh(name, kind)
+		if name == "" {
+			t.name = keyword + " {...}"
+		}
+	}
+
+	// just a reference, maybe to something we haven't seen the body of;
+	// that's fine as long as it's only pointed to
+	if !self.accept("{") {
+		if name == "" {
+			return nil, fmt.Errorf("%s with no name or body", keyword)
+		}
+		return t, nil
+	}
+
+	// a type we didn't make gets a new one rather than changing under
+	// whatever already uses it: structs that embed one that's redefined
+	// keep the layout they were built with, and one that was only declared
+	// gets its body when (and if) we keep this header's types
+	if t.fields != nil || !self.made[t] {
+		old := t
+		t = self.fresh(name, kind)
+		if old.fields == nil && !self.made[old] {
+			self.completes[old] = name
+		}
+	}
+	t.fields = []field{}
+
+	for !self.accept("}") {
+		if self.eof() {
+			return nil, fmt.Errorf("missing '}' in %s", name)
+		}
+
+		base, err := self.base()
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			ft, fname, err := self.declarator(base)
+			if err != nil {
+				return nil, err
+			}
+
+			if fname == "" {
+				return nil, fmt.Errorf("member with no name in %s", name)
+			}
+
+			if ft.kind != pointerKind && ft.size == 0 {
+				return nil, fmt.Errorf("%s in %s has incomplete type", fname, name)
+			}
+
+			f := field{name: fname, typ: ft}
+			if kind == structKind {
+				f.off = t.size
+				t.size += ft.size
+			} else if ft.size > t.size {
+				t.size = ft.size
+			}
+
+			t.fields = append(t.fields, f)
+
+			if !self.accept(",") {
+				break
+			}
+		}
+
+		if err := self.expect(";"); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// fresh makes a struct or union for this header, under name if it has one
+func (self *headerParser) fresh(name string, kind typeKind) *ctype {
+	t := &ctype{name: name, kind: kind}
+	if name != "" {
+		self.types[name] = t
+	}
+	self.made[t] = true
+	return t
+}
+
+// skip skips from an open bracket to the one that closes it
+func (self *headerParser) skip(open, close string) error {
+	depth := 0
+	for !self.eof() {
+		switch self.next() {
+		case open:
+			depth++
+		case close:
+			if depth--; depth == 0 {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("missing '%s'", close)
+}
+
+// declarator parses "*name[4]" and the like, returning the declared type
+// and name (which can be empty in a type name)
+func (self *headerParser) declarator(base *ctype) (*ctype, string, error) {
+	t := base
+
+	for self.accept("*") {
+		for self.accept("const") || self.accept("volatile") {
+		}
+		t = pointerTo(t)
+	}
+
+	if self.peek() == "(" {
+		return nil, "", fmt.Errorf("function pointers aren't supported")
+	}
+
+	name := ""
+	if tok := self.peek(); tok != "" && tok != "[" && tok != ";" && tok != "," && tok != ")" {
+		name = self.next()
+	}
+
+	dims := []int{}
+	for self.accept("[") {
+		tok := self.next()
+		n, err := strconv.ParseInt(tok, 0, 32)
+		if err != nil || n < 1 {
+			return nil, "", fmt.Errorf("bad array size '%s'", tok)
+		}
+		dims = append(dims, int(n))
+
+		if err := self.expect("]"); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if self.peek() == ":" {
+		return nil, "", fmt.Errorf("bitfields aren't supported")
+	}
+
+	for i := len(dims) - 1; i >= 0; i-- {
+		t = arrayOf(t, dims[i])
+	}
+
+	return t, name, nil
+}
+
+// loadTypes reads declarations from a header file; if there's anything in
+// it we can't handle, none of it is kept. Function prototypes (and inline
+// function bodies) are skipped.
+func loadTypes(file string) (int, error) {
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+
+	p := &headerParser{
+		toks:      cTokens(string(src)),
+		loading:   true,
+		types:     map[string]*ctype{},
+		made:      map[*ctype]bool{},
+		completes: map[*ctype]string{},
+	}
+	for name, t := range userTypes {
+		p.types[name] = t
+	}
+
+	count := 0
+
+	for !p.eof() {
+		if p.accept(";") {
+			continue
+		}
+
+		typedef := p.accept("typedef")
+
+		base, err := p.base()
+		if err != nil {
+			return count, err
+		}
+
+		function := false
+		for !p.accept(";") {
+			t, name, err := p.declarator(base)
+			if err != nil {
+				return count, err
+			}
+
+			// a function; if it has a body, that's the end of it
+			if p.peek() == "(" && !typedef {
+				function = true
+				if err := p.skip("(", ")"); err != nil {
+					return count, err
+				}
+				if p.peek() == "{" {
+					if err := p.skip("{", "}"); err != nil {
+						return count, err
+					}
+					break
+				}
+			}
+
+			// variables we don't care about; typedefs we do
+			if typedef && name != "" {
+				if strings.HasSuffix(t.name, "{...}") {
+					t.name = name
+				}
+				p.types[name] = t
+				count++
+			}
+
+			if !p.accept(",") {
+				if err := p.expect(";"); err != nil {
+					return count, err
+				}
+				break
+			}
+		}
+
+		if !function {
+			count++
+		}
+	}
+
+	for old, name := range p.completes {
+		*old = *p.types[name]
+	}
+	userTypes = p.types
+
+	return count, nil
+}
+
+// scalarAt reads a little-endian number of type t from the start of blob
+func scalarAt(t *ctype, blob []byte) int64 {
+	var n int64
+	for i := t.size - 1; i >= 0; i-- {
+		n = n<<8 | int64(blob[i])
+	}
+	return extend(n, t)
+}
+
+// cArrayMax is the most elements we'll print of an array
+const cArrayMax = 32
+
+// formatBytes renders a value of type t from its bytes in memory, in one
+// of the print formats (0 for the default)
+func formatBytes(t *ctype, blob []byte, f byte) string {
+	if len(blob) < t.size {
+		return "<unreadable>"
+	}
+
+	switch t.kind {
+	case structKind, unionKind:
+		parts := []string{}
+		for _, fl := range t.fields {
+			parts = append(parts, fmt.Sprintf("%s = %s", fl.name, formatBytes(fl.typ, blob[fl.off:], f)))
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+
+	case arrayKind:
+		if t.elem.isChar() && f == 0 {
+			text := blob[:t.size]
+			if i := strings.IndexByte(string(text), 0); i != -1 {
+				text = text[:i]
+			}
+			return strconv.Quote(string(text))
+		}
+
+		parts := []string{}
+		for i := 0; i < t.count; i++ {
+			if i == cArrayMax {
+				parts = append(parts, "...")
+				break
+			}
+			parts = append(parts, formatBytes(t.elem, blob[i*t.elem.size:], f))
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+
+	case pointerKind:
+		return fmt.Sprintf("0x%0.4x", binary.LittleEndian.Uint16(blob))
+
+	case floatKind:
+		return fmt.Sprintf("%g", math.Float32frombits(binary.LittleEndian.Uint32(blob)))
+	}
+
+	n := scalarAt(t, blob)
+	if f == 0 {
+		if t.isChar() && n >= 32 && n < 127 {
+			return fmt.Sprintf("%d '%c'", n, rune(n))
+		}
+		return fmt.Sprintf("%d", n)
+	}
+
+	return format(value{n: n, typ: t}, f)
+}
+
+// fieldRows lays out a value of type t at addr, one row per scalar; nested
+// structs and arrays of structs are flattened with dotted names
+func fieldRows(t *ctype, blob []byte, addr, off int, name string) (rows []string) {
+	switch {
+	case t.kind == structKind || t.kind == unionKind:
+		for _, fl := range t.fields {
+			sub := fl.name
+			if name != "" {
+				sub = name + "." + fl.name
+			}
+			rows = append(rows, fieldRows(fl.typ, blob, addr, off+fl.off, sub)...)
+		}
+		return
+
+	case t.kind == arrayKind && t.elem.aggregate():
+		for i := 0; i < t.count && i < cArrayMax; i++ {
+			rows = append(rows, fieldRows(t.elem, blob, addr, off+i*t.elem.size, fmt.Sprintf("%s[%d]", name, i))...)
+		}
+		return
+	}
+
+	val := "<unreadable>"
+	if off+t.size <= len(blob) {
+		if t.kind == scalarKind {
+			val = format(value{n: scalarAt(t, blob[off:]), typ: t}, 0)
+		} else {
+			val = formatBytes(t, blob[off:], 0)
+		}
+	}
+
+	return []string{fmt.Sprintf("%0.4x +%0.2x  %-24s %s", addr+off, off, declare(t, name), val)}
+}
+
+// typeLines is what ptype prints for a type: its name, and for structs and
+// unions, their members with offsets
+func typeLines(t *ctype) []string {
+	for t.kind == pointerKind || t.kind == arrayKind {
+		if t.elem.kind != structKind && t.elem.kind != unionKind && t.elem.kind != pointerKind && t.elem.kind != arrayKind {
+			break
+		}
+		t = t.elem
+	}
+
+	if t.kind != structKind && t.kind != unionKind {
+		return []string{fmt.Sprintf("type = %s  (%d bytes)", typeName(t), t.size)}
+	}
+
+	lines := []string{fmt.Sprintf("type = %s {  (%d bytes)", typeName(t), t.size)}
+	for _, fl := range t.fields {
+		lines = append(lines, fmt.Sprintf("    +0x%0.2x  %s;", fl.off, declare(fl.typ, fl.name)))
+	}
+
+	return append(lines, "}")
+}
+
+// ptype prints a type, or the type of an expression
+func ptype(src string) bool {
+	t, err := parseTypeName(src)
+	if err != nil {
+		ctx, cerr := liveContext()
+		if cerr != nil {
+			logError("ptype", cerr)
+			return false
+		}
+
+		v, verr := evaluate(src, ctx)
+		if verr != nil {
+			logf("'%s' isn't a type (%s) or an expression (%s)", src, err, verr)
+			return false
+		}
+
+		if t = v.typ; t == nil {
+			t = cTypes["int"]
+		}
+	}
+
+	for _, l := range typeLines(t) {
+		logf("%s", l)
+	}
+
+	return true
+}
+
+func typesCommand(toks []string) bool {
+	if len(toks) > 2 && toks[1] == "load" {
+		n, err := loadTypes(toks[2])
+		if err != nil {
+			logf("loading %s: %s (after %d declarations)", toks[2], err, n)
+			return false
+		}
+		logf("loaded %d declarations from %s", n, toks[2])
+		return true
+	}
+
+	if len(toks) > 1 {
+		logf("types [load <file>]")
+		return false
+	}
+
+	names := []string{}
+	for name := range userTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		logf("%-24s %d bytes", name, userTypes[name].size)
+	}
+
+	return true
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math"
+	"sync"
 	"time"
 
 	"github.com/jroimartin/gocui"
@@ -16,8 +20,23 @@ type dump struct {
 	contents []byte
 	written  bool
 	addr     uint16
-	sx, sy   int
+	viewSize
 	lastpc   uint16
+	past     *traceEntry
+	prev     []byte // what contents was before the PC last moved
+	fetchpc  int    // the PC when we fetched contents
+	fetchadr uint16 // ...and the address
+	cursor   uint16
+	group    int      // bytes per group: 1, 2 or 4
+	trail    []uint16 // where we followed pointers from
+	as       *ctype   // show memory at the cursor as this type, not hex
+	asBytes  []byte
+
+	// what we last fetched, for the trace, which records it from other
+	// goroutines
+	shownLock sync.Mutex
+	shownAddr uint16
+	shownSize int
 }
 
 func (self *dump) deliver(e event) {
@@ -52,80 +71,300 @@ func peek(addr uint16, size int) (ret []byte) {
 	return buf
 }
 
+// peekAll is peek without the size limit; it reads in chunks, and returns
+// nil if any of them fail
+func peekAll(addr uint16, size int) (ret []byte) {
+	for size > 0 {
+		blob := peek(addr, size)
+		if len(blob) == 0 {
+			return nil
+		}
+
+		ret = append(ret, blob...)
+		addr += uint16(len(blob))
+		size -= len(blob)
+	}
+
+	return
+}
+
 func (self *dump) makechan() {
 	self.c = make(chan event)
 }
 
-// draw a simple hex dump, filling available space
+// layout works out how many bytes fit on a line (a power of two, so lines
+// stay aligned) and how many lines fit in the view
+func (self *dump) layout() (perRow, rows int) {
+	group := self.group
+	if group == 0 {
+		group = 1
+	}
+
+	perRow = 4
+	for _, n := range []int{32, 16, 8} {
+		// "XXXX:  " + hex with a space after each group + " |ascii|"
+		if 7+n*2+n/group+1+n+2 <= self.sx {
+			perRow = n
+			break
+		}
+	}
+
+	rows = self.sy - 2
+	if rows < 1 {
+		rows = 1
+	}
+
+	return
+}
+
+// readout describes the bytes at addr: the byte, and what they'd be read
+// little-endian as wider things
+func readout(addr uint16, blob []byte) string {
+	out := &bytes.Buffer{}
+
+	fmt.Fprintf(out, "%0.4x", addr)
+	if sym := Listing.symbolize(int(addr)); sym != "??" {
+		fmt.Fprintf(out, " <%s>", sym)
+	}
+
+	if len(blob) == 0 {
+		return out.String()
+	}
+
+	c := '.'
+	if blob[0] >= 32 && blob[0] < 127 {
+		c = rune(blob[0])
+	}
+	fmt.Fprintf(out, "  %0.2x '%c'", blob[0], c)
+
+	if len(blob) >= 2 {
+		u16 := binary.LittleEndian.Uint16(blob)
+		fmt.Fprintf(out, "  u16 %d s16 %d", u16, int16(u16))
+	}
+
+	if len(blob) >= 4 {
+		u32 := binary.LittleEndian.Uint32(blob)
+		fmt.Fprintf(out, "  u32 %d f32 %g", u32, math.Float32frombits(u32))
+	}
+
+	return out.String()
+}
+
+// draw a hex dump with an ASCII column, filling available space; the byte
+// under the cursor is shown in reverse, and bytes that changed since the PC
+// last moved are highlighted
 func (self *dump) draw(v *gocui.View, refresh bool) {
 	if refresh {
 		self.written = false
 	}
 
+	if self.resized(v) {
+		self.written = false
+		go self.deliver(event{kind: RESIZE})
+	}
+
 	if self.written {
 		return
 	}
 
 	v.Clear()
 
-	self.sx, self.sy = v.Size()
+	addr, contents, prev := self.addr, self.contents, self.prev
+	if self.past != nil {
+		prev = nil
+		addr, contents = self.past.mem.addr, self.past.mem.bytes
+		fmt.Fprintf(v, "HISTORICAL STATE #%d\n", self.past.n)
+	}
 
-	xpos := 0
-	ypos := 0
+	group := self.group
+	if group == 0 {
+		group = 1
+	}
+
+	if self.as != nil {
+		self.drawAs(v, addr, contents)
+		self.written = true
+		return
+	}
 
-	p, _ := fmt.Fprintf(v, "%0.4X:   ", self.addr)
-	xpos += p
-	bytesThisLine := 1
+	perRow, rows := self.layout()
 
-	for off, b := range self.contents {
-		need := 3
-		pad := " "
-		if bytesThisLine != 1 && bytesThisLine%4 == 0 {
-			need += 2
-			pad = "   "
+	var under []byte
+	if off := int(self.cursor) - int(addr); off >= 0 && off < len(contents) {
+		under = contents[off:]
+		if len(under) > 4 {
+			under = under[:4]
 		}
-		if xpos < (self.sx - need) {
-			bytesThisLine++
-			p, _ = fmt.Fprintf(v, "%.2x%s", b, pad)
-			xpos += p
-		} else {
-			xpos = 0
-			bytesThisLine = 2
-			ypos += 1
+	}
+	fmt.Fprintf(v, "%s\n\n", readout(self.cursor, under))
 
-			v.Write([]byte("\n"))
+	// escapes to start and end highlighting the byte at off
+	attr := func(off int) (start, end string) {
+		if addr+uint16(off) == self.cursor {
+			start = "\x1b[7m"
+		}
+		if off < len(prev) && prev[off] != contents[off] {
+			start += theme["changed"]
+		}
+		if start != "" {
+			end = "\x1b[0m"
+		}
+		return
+	}
 
-			if ypos == self.sy {
-				break
+	for row := 0; row < rows && row*perRow < len(contents); row++ {
+		first := row * perRow
+		last := first + perRow
+		if last > len(contents) {
+			last = len(contents)
+		}
+
+		fmt.Fprintf(v, "%0.4x:  ", addr+uint16(first))
+
+		for off := first; off < first+perRow; off++ {
+			if off < last {
+				start, end := attr(off)
+				fmt.Fprintf(v, "%s%0.2x%s", start, contents[off], end)
+			} else {
+				fmt.Fprintf(v, "  ")
 			}
 
-			p, _ = fmt.Fprintf(v, "%0.4X:   %0.2x ", self.addr+uint16(off), b)
-			xpos += p
+			if (off+1)%group == 0 {
+				fmt.Fprintf(v, " ")
+			}
 		}
-	}
 
-	v.Write([]byte("\n"))
+		fmt.Fprintf(v, " |")
+		for off := first; off < last; off++ {
+			c := contents[off]
+			if c < 32 || c > 126 {
+				c = '.'
+			}
+
+			start, end := attr(off)
+			fmt.Fprintf(v, "%s%c%s", start, c, end)
+		}
+		fmt.Fprintf(v, "|\n")
+	}
 
 	self.written = true
 }
 
+// drawAs shows the memory at the cursor as a C type, a row per member
+func (self *dump) drawAs(v *gocui.View, addr uint16, contents []byte) {
+	blob := self.asBytes
+
+	// in history, we only have what the trace recorded
+	if self.past != nil {
+		blob = nil
+		if off := int(self.cursor) - int(addr); off >= 0 && off+self.as.size <= len(contents) {
+			blob = contents[off:]
+		}
+	}
+
+	fmt.Fprintf(v, "%s at %0.4x  (%d bytes)\n\n", typeName(self.as), self.cursor, self.as.size)
+
+	for _, row := range fieldRows(self.as, blob, int(self.cursor), 0, "") {
+		fmt.Fprintf(v, "%s\n", row)
+	}
+}
+
 // update re-fetches memory when dump.addr changes, then asks to be redrawn
 func (self *dump) update() {
 	size := 16 * 8
 	if self.sx != 0 {
-		size = (self.sx * self.sy) / 2
+		perRow, rows := self.layout()
+		size = perRow * rows
 	}
+
+	// keep the old contents to compare against, unless we've moved or
+	// nothing has run since the last fetch
+	pc := CurrentStatus.stat.Cpu.Pc
+	if self.addr != self.fetchadr {
+		self.prev = nil
+	} else if pc != self.fetchpc {
+		self.prev = self.contents
+	}
+	self.fetchpc, self.fetchadr = pc, self.addr
+
 	self.contents = peek(self.addr, size)
+
+	self.shownLock.Lock()
+	self.shownAddr, self.shownSize = self.addr, len(self.contents)
+	self.shownLock.Unlock()
+
+	if self.as != nil {
+		self.asBytes = peekAll(self.cursor, self.as.size)
+	}
 	self.written = false
 	redraw()
 }
 
-func (self *dump) init() {
-	time.Sleep(2 * time.Second)
+// window returns the range of memory the dump tab is showing; unlike the
+// rest of dump, it's safe to call from any goroutine
+func (self *dump) window() (addr uint16, size int) {
+	self.shownLock.Lock()
+	defer self.shownLock.Unlock()
+
+	return self.shownAddr, self.shownSize
+}
+
+// moveTo puts the cursor at addr, scrolling if it's off the screen;
+// it returns whether we scrolled, in which case we need to re-fetch
+func (self *dump) moveTo(addr int) bool {
+	if addr < 0 {
+		addr = 0
+	} else if addr > 0xffff {
+		addr = 0xffff
+	}
+
+	self.cursor = uint16(addr)
+	self.written = false
+
+	perRow, rows := self.layout()
+	top, end := int(self.addr), int(self.addr)+perRow*rows
+
+	switch {
+	case self.as != nil:
+		// there's no scrolling, but what we show depends on the cursor
+		self.addr = self.cursor
+	case addr < top:
+		if top -= ((top - addr + perRow - 1) / perRow) * perRow; top < 0 {
+			top = 0
+		}
+		self.addr = uint16(top)
+	case addr >= end:
+		// stop at the last screenful rather than wrapping to low memory
+		top += ((addr-end)/perRow + 1) * perRow
+		if last := 0x10000 - perRow*rows; top > last {
+			top = last
+		}
+		if top < 0 {
+			top = 0
+		}
+		self.addr = uint16(top)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// pointerAt reads the little-endian word under the cursor
+func (self *dump) pointerAt() (int, bool) {
+	if off := int(self.cursor) - int(self.addr); off >= 0 && off+1 < len(self.contents) {
+		return int(binary.LittleEndian.Uint16(self.contents[off:])), true
+	}
+
+	blob := peek(self.cursor, 2)
+	if len(blob) < 2 {
+		return 0, false
+	}
 
-	v, _ := g.View("tabview")
-	self.sx, self.sy = v.Size()
+	return int(binary.LittleEndian.Uint16(blob)), true
+}
 
+func (self *dump) init() {
 	// memory fetch requests can get expensive; don't issue them on every
 	// keystroke or status update
 
@@ -179,6 +418,7 @@ func (self *dump) loop() {
 		// set a new address to dump
 		case FETCH:
 			self.addr = uint16(e.addr)
+			self.cursor = self.addr
 			self.update()
 
 			// set a new address from status update (rate limited)
@@ -188,19 +428,97 @@ func (self *dump) loop() {
 				self.live <- true
 			}
 
+			// the view changed size
+		case RESIZE:
+			self.update()
+
+			// show (or stop showing) a state from the trace
+		case HISTORY:
+			self.past = History.entry()
+			if self.past == nil {
+				self.update()
+			}
+			self.written = false
+			redraw()
+
 			// page up
 		case UP:
-			if (self.addr - (16 * 8)) > 0 {
-				self.addr -= (16 * 8)
+			perRow, rows := self.layout()
+			if self.moveTo(int(self.cursor) - perRow*rows) {
 				self.demand <- true
 			}
+			redraw()
 
 			// page down
 		case DOWN:
-			if (self.addr + (16 * 8)) < 0xffff {
-				self.addr += (16 * 8)
+			perRow, rows := self.layout()
+			if self.moveTo(int(self.cursor) + perRow*rows) {
+				self.demand <- true
+			}
+			redraw()
+
+			// move the cursor by e.addr bytes, or lines if data is "line"
+		case DUMP_MOVE:
+			delta := e.addr
+			if e.data == "line" {
+				perRow, _ := self.layout()
+				delta *= perRow
+			}
+
+			if self.moveTo(int(self.cursor) + delta) {
 				self.demand <- true
 			}
+			redraw()
+
+		case DUMP_GOTO:
+			if self.moveTo(e.addr) {
+				self.update()
+			}
+			redraw()
+
+			// jump to the address stored at the cursor
+		case DUMP_FOLLOW:
+			ptr, ok := self.pointerAt()
+			if !ok {
+				logf("can't read pointer at %0.4x", self.cursor)
+				break
+			}
+
+			self.trail = append(self.trail, self.cursor)
+			if self.moveTo(ptr) {
+				self.update()
+			}
+			redraw()
+
+			// go back to where we last followed a pointer from
+		case DUMP_BACK:
+			if len(self.trail) == 0 {
+				break
+			}
+
+			back := self.trail[len(self.trail)-1]
+			self.trail = self.trail[:len(self.trail)-1]
+			if self.moveTo(int(back)) {
+				self.update()
+			}
+			redraw()
+
+		case DUMP_GROUP:
+			self.group = e.addr
+			self.update()
+
+			// show memory as a C type, or as hex if data is empty
+		case DUMP_AS:
+			self.as = nil
+			if e.data != "" {
+				typ, err := parseTypeName(e.data)
+				if err != nil {
+					logf("%s", err)
+					break
+				}
+				self.as = typ
+			}
+			self.update()
 		}
 	}
 }
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// gdb's "x" command. "x/NFU <loc>" shows N units of size U (b, h, w: 1, 2
+// or 4 bytes) in format F:
+//
+//   x d u t c       hex, signed, unsigned, binary, character
+//   s               NUL-terminated strings (N of them)
+//   i               instructions from the listing (N of them)
+//
+// Multi-byte units are little-endian, like the AVR. Any of N, F, and U can
+// be left out; F and U default to whatever was used last, and "x" with no
+// location carries on from where the last one stopped.
+//
+// <loc> is a location (see locate()), or "@<expr>" to use the value of an
+// expression, e.g. "@Y+4" or "@r25:r24". A bare register or pair with no @
+// just shows the register, like "r/8 r24" always did.
+//
+// The old read commands are spellings of the same thing: r/8 is x/1xb,
+// r/16 is x/1xh, r/s is x/1s, and r/m is x/32xb.
+
+// examineStrMax is the longest string "x/s" will show
+const examineStrMax = 256
+
+var examineAliases = map[string]string{
+	"8": "1xb", "b": "1xb", "byte": "1xb",
+	"16": "1xh", "w": "1xh", "word": "1xh",
+	"s": "1s", "str": "1s", "string": "1s",
+	"m": "32xb", "mem": "32xb", "memory": "32xb",
+}
+
+var rxreg = regexp.MustCompile(`^\$?[rR][0-9]+(:\$?[rR]?[0-9]+)?$`)
+
+// examined is what the last "x" looked at, so the next one can carry on;
+// after x/i, next is a code address, which is no use for data, and the
+// other way around
+var examined = struct {
+	format byte
+	unit   int
+	next   int
+	code   bool
+}{format: 'x', unit: 1, next: -1}
+
+// examine runs an x/NFU (or r/, read/) command line, returning false if
+// it couldn't
+func examine(line string) bool {
+	toks := strings.SplitN(line, " ", 2)
+
+	spec := ""
+	if i := strings.Index(toks[0], "/"); i != -1 {
+		spec = toks[0][i+1:]
+
+		// r/8 and friends mean what they always did, but x/8 and x/w mean
+		// what they do in gdb; only the spelled-out names work for both
+		isX := strings.HasPrefix(toks[0], "x/")
+		if alias, ok := examineAliases[spec]; ok && (!isX || len(spec) > 2 || spec == "m") {
+			spec = alias
+		}
+	}
+
+	count, format, unit, err := parseExamine(spec)
+	if err != nil {
+		logf("%s; x/NFU <loc>, F is x/d/u/t/c/s/i, U is b/h/w", err)
+		return false
+	}
+
+	arg := ""
+	if len(toks) > 1 {
+		arg = strings.TrimSpace(toks[1])
+	}
+
+	if rxreg.MatchString(arg) {
+		f := format
+		if !strings.ContainsRune("xdutc", rune(f)) {
+			f = 'x'
+		}
+		return printExpr(arg, f)
+	}
+
+	addr, err := examineAddr(arg, format)
+	if err != nil {
+		logf("%s", err)
+		return false
+	}
+
+	examined.format, examined.unit = format, unit
+	examined.code = format == 'i'
+
+	switch format {
+	case 'i':
+		examined.next = examineInsns(addr, count)
+	case 's':
+		examined.next = examineStrings(addr, count)
+	default:
+		examined.next = examineUnits(addr, count, unit, format)
+	}
+
+	if examined.next > 0xffff {
+		examined.next = -1
+	}
+
+	return true
+}
+
+// parseExamine parses the NFU part of x/NFU
+func parseExamine(spec string) (count int, format byte, unit int, err error) {
+	count, format, unit = 1, examined.format, examined.unit
+
+	digits := 0
+	for digits < len(spec) && spec[digits] >= '0' && spec[digits] <= '9' {
+		digits++
+	}
+
+	if digits > 0 {
+		if count, err = strconv.Atoi(spec[:digits]); err != nil || count < 1 {
+			return 0, 0, 0, fmt.Errorf("bad count '%s'", spec[:digits])
+		}
+	}
+
+	for _, c := range spec[digits:] {
+		switch c {
+		case 'x', 'd', 'u', 't', 'c', 's', 'i':
+			format = byte(c)
+		case 'b':
+			unit = 1
+		case 'h':
+			unit = 2
+		case 'w':
+			unit = 4
+		default:
+			return 0, 0, 0, fmt.Errorf("bad format or unit '%c'", c)
+		}
+	}
+
+	return
+}
+
+// examineAddr works out where an "x" starts
+func examineAddr(arg string, format byte) (int, error) {
+	if arg == "" {
+		if examined.next == -1 {
+			return 0, fmt.Errorf("x where?")
+		}
+		if examined.code && format != 'i' {
+			return 0, fmt.Errorf("x where? the last x was of code, not data")
+		}
+		if !examined.code && format == 'i' {
+			return 0, fmt.Errorf("x where? the last x was of data, not code")
+		}
+		return examined.next, nil
+	}
+
+	if !strings.HasPrefix(arg, "@") {
+		kind := dataLoc
+		if format == 'i' {
+			kind = codeLoc
+		}
+		return locate(arg, kind)
+	}
+
+	// a plain number is hex, like everywhere else we take an address
+	src := strings.TrimSpace(arg[1:])
+	if _, err := strconv.ParseUint(src, 16, 16); err == nil {
+		return locate(src, dataLoc)
+	}
+
+	ctx, err := liveContext()
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := evaluate(src, ctx)
+	if err != nil {
+		return 0, fmt.Errorf("can't evaluate '%s': %s", src, err)
+	}
+
+	if v.n < 0 || v.n > 0xffff {
+		return 0, fmt.Errorf("%s is out of range (%x)", src, v.n)
+	}
+
+	return int(v.n), nil
+}
+
+// examineUnits shows count little-endian units of size bytes, and returns
+// the address after them
+func examineUnits(addr, count, size int, format byte) int {
+	if addr+count*size > 0x10000 {
+		count = (0x10000 - addr) / size
+	}
+
+	blob := peekAll(uint16(addr), count*size)
+	if len(blob) < count*size {
+		logf("can't read %0.4x", addr)
+		return -1
+	}
+
+	perRow := 8
+	if size == 4 || format == 't' {
+		perRow = 4
+	}
+
+	typ := &ctype{size: size, signed: format == 'd'}
+
+	for row := 0; row < count; row += perRow {
+		cells := []string{}
+
+		for i := row; i < count && i < row+perRow; i++ {
+			n := int64(0)
+			for j := size - 1; j >= 0; j-- {
+				n = n<<8 | int64(blob[i*size+j])
+			}
+			cells = append(cells, examineCell(extend(n, typ), size, format))
+		}
+
+		logf("%0.4x:  %s", addr+row*size, strings.Join(cells, " "))
+	}
+
+	return addr + count*size
+}
+
+func examineCell(n int64, size int, format byte) string {
+	switch format {
+	case 'd', 'u':
+		return fmt.Sprintf("%*d", size*3+1, n)
+	case 't':
+		return fmt.Sprintf("%0*b", size*8, n)
+	case 'c':
+		if n >= 32 && n < 127 {
+			return fmt.Sprintf("%3d '%c'", n, n)
+		}
+		return fmt.Sprintf("%3d '\\x%0.2x'", n, n&0xff)
+	}
+
+	return fmt.Sprintf("%0*x", size*2, n)
+}
+
+// examineStrings shows count NUL-terminated strings, and returns the
+// address after the last one
+func examineStrings(addr, count int) int {
+	for ; count > 0 && addr <= 0xffff; count-- {
+		size := examineStrMax
+		if addr+size > 0x10000 {
+			size = 0x10000 - addr
+		}
+
+		blob := peek(uint16(addr), size)
+		if blob == nil {
+			logf("can't read %0.4x", addr)
+			return -1
+		}
+
+		end := bytes.IndexByte(blob, 0)
+		more := ""
+		if end == -1 {
+			end = len(blob)
+			more = "..."
+		}
+
+		logf("%0.4x:  %q%s", addr, string(blob[:end]), more)
+		addr += end + 1
+	}
+
+	return addr
+}
+
+// examineInsns shows count instructions from the listing, and returns the
+// address after the last one
+func examineInsns(addr, count int) int {
+	for ; count > 0; count-- {
+		insn := Listing.insnAt(addr)
+		if insn == nil {
+			logf("no instruction at %0.4x", addr)
+			return -1
+		}
+
+		logf("%s  <%s>", insn.String(), Listing.symbolize(addr))
+
+		if addr = Listing.next(addr); addr == -1 {
+			return -1
+		}
+	}
+
+	return addr
+}
@@ -0,0 +1,789 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The expression evaluator behind "print". It's a little recursive-descent
+// parser that evaluates as it goes; there's no tree. Expressions can use:
+//
+//   numbers         42, 0x2a, 0b101010, 'a'
+//   registers       r24, r25:r24 (a pair), X, Y, Z, SP, PC, SREG
+//   flags           SREG.I SREG.T SREG.H SREG.S SREG.V SREG.N SREG.Z SREG.C
+//   symbols         anything in the listing's symbol table
+//   operators       the C ones: * / % + - << >> < <= > >= == != & ^ | && ||
+//                   and unary - ~ !
+//   dereference     *u8 addr, *s8, *u16, *s16, *u32, *s32 (plain * is *u8)
+//   C types         casts to loaded types, (struct foo *)addr, and then
+//                   *p, p->field, s.field, a[i]
+//
+// Registers and symbols can be written with a leading $ ($pc, $r24). Memory
+// is read from the device little-endian, or when we're looking at history,
+// from what the trace copied at the time (which is only what the stack and
+// dump tabs were showing).
+
+// ctype describes what a value is, so we know how wide it is and whether it
+// should be printed signed; the C types in ctypes.go use the rest
+type ctype struct {
+	name   string
+	size   int
+	signed bool
+	kind   typeKind
+	fields []field // structs and unions
+	elem   *ctype  // pointers and arrays
+	count  int     // arrays
+}
+
+var scalarTypes = map[string]*ctype{
+	"u8":  {name: "u8", size: 1},
+	"s8":  {name: "s8", size: 1, signed: true},
+	"u16": {name: "u16", size: 2},
+	"s16": {name: "s16", size: 2, signed: true},
+	"u32": {name: "u32", size: 4},
+	"s32": {name: "s32", size: 4, signed: true},
+}
+
+// value is the result of evaluating an expression; typ is nil for plain
+// integers, and for structs and arrays, n is the address
+type value struct {
+	n   int64
+	typ *ctype
+}
+
+func (self value) size() int {
+	if self.typ == nil {
+		return 0
+	}
+	return self.typ.size
+}
+
+// flagBits maps SREG flag names to bit numbers
+var flagBits = map[string]uint{
+	"c": 0, "z": 1, "n": 2, "v": 3, "s": 4, "h": 5, "t": 6, "i": 7,
+}
+
+// evalContext is what an expression is evaluated against
+type evalContext struct {
+	cpu  *ApuState
+	past *traceEntry // the recorded state cpu came from, if it's history
+}
+
+// liveContext returns a context for the state we're showing: a recorded one
+// if we're looking at history, otherwise whatever the device says now
+func liveContext() (*evalContext, error) {
+	if e := History.entry(); e != nil {
+		return &evalContext{cpu: &e.stat().Cpu, past: e}, nil
+	}
+
+	stat, err := fetchStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	return &evalContext{cpu: &stat.Cpu}, nil
+}
+
+// read returns size bytes at addr, as they are now or as they were recorded;
+// memory the trace didn't copy is an error rather than today's contents
+func (self *evalContext) read(addr uint16, size int) ([]byte, error) {
+	if self.past == nil {
+		blob := peekAll(addr, size)
+		if len(blob) < size {
+			return nil, fmt.Errorf("can't read %0.4x", addr)
+		}
+		return blob, nil
+	}
+
+	for _, snap := range []memSnap{self.past.stack, self.past.mem} {
+		off := int(addr) - int(snap.addr)
+		if off >= 0 && off+size <= len(snap.bytes) {
+			return snap.bytes[off : off+size], nil
+		}
+	}
+
+	return nil, fmt.Errorf("%0.4x wasn't recorded in #%d", addr, self.past.n)
+}
+
+// readMem reads size bytes at addr as a little-endian number
+func (self *evalContext) readMem(addr int64, typ *ctype) (value, error) {
+	if addr < 0 || addr > 0xffff {
+		return value{}, fmt.Errorf("address %x out of range", addr)
+	}
+
+	blob, err := self.read(uint16(addr), typ.size)
+	if err != nil {
+		return value{}, err
+	}
+
+	var n int64
+	for i := typ.size - 1; i >= 0; i-- {
+		n = n<<8 | int64(blob[i])
+	}
+
+	return value{n: extend(n, typ), typ: typ}, nil
+}
+
+// extend sign-extends (or truncates) n to fit typ
+func extend(n int64, typ *ctype) int64 {
+	if typ == nil || typ.size == 0 || typ.size >= 8 {
+		return n
+	}
+
+	bits := uint(typ.size * 8)
+	n &= (1 << bits) - 1
+	if typ.signed && n&(1<<(bits-1)) != 0 {
+		n -= 1 << bits
+	}
+
+	return n
+}
+
+type tokKind int
+
+const (
+	tEOF tokKind = iota
+	tNum
+	tIdent
+	tOp
+)
+
+type token struct {
+	kind tokKind
+	text string
+	n    int64
+}
+
+var twoCharOps = []string{"<<", ">>", "<=", ">=", "==", "!=", "&&", "||", "->"}
+
+func isIdentByte(c byte, first bool) bool {
+	switch {
+	case c == '_' || c == '$' || c == '.':
+		return true
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return true
+	case c >= '0' && c <= '9':
+		return !first
+	}
+	return false
+}
+
+func lex(src string) ([]token, error) {
+	toks := []token{}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && isIdentByte(src[j], false) && src[j] != '.' && src[j] != '$' {
+				j++
+			}
+
+			n, err := strconv.ParseInt(src[i:j], 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad number '%s'", src[i:j])
+			}
+
+			toks = append(toks, token{kind: tNum, text: src[i:j], n: n})
+			i = j
+
+		case c == '\'':
+			if i+2 >= len(src) || src[i+2] != '\'' {
+				return nil, fmt.Errorf("bad character constant")
+			}
+
+			toks = append(toks, token{kind: tNum, text: src[i : i+3], n: int64(src[i+1])})
+			i += 3
+
+		case isIdentByte(c, true):
+			j := i
+			for j < len(src) && isIdentByte(src[j], j == i) {
+				j++
+			}
+
+			toks = append(toks, token{kind: tIdent, text: src[i:j]})
+			i = j
+
+		default:
+			op := string(c)
+			for _, two := range twoCharOps {
+				if strings.HasPrefix(src[i:], two) {
+					op = two
+				}
+			}
+
+			if !strings.Contains("+-*/%<>=!&|^~():[]", string(op[0])) || op == "=" {
+				return nil, fmt.Errorf("unexpected '%s'", op)
+			}
+
+			toks = append(toks, token{kind: tOp, text: op})
+			i += len(op)
+		}
+	}
+
+	return append(toks, token{kind: tEOF}), nil
+}
+
+type parser struct {
+	toks []token
+	pos  int
+	ctx  *evalContext
+}
+
+func (self *parser) peek() token {
+	return self.toks[self.pos]
+}
+
+func (self *parser) next() token {
+	t := self.toks[self.pos]
+	if t.kind != tEOF {
+		self.pos++
+	}
+	return t
+}
+
+func (self *parser) accept(op string) bool {
+	if t := self.peek(); t.kind == tOp && t.text == op {
+		self.pos++
+		return true
+	}
+	return false
+}
+
+// binary operators by precedence, loosest first
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (self *parser) binary(level int) (value, error) {
+	if level == len(precedence) {
+		return self.unary()
+	}
+
+	lhs, err := self.binary(level + 1)
+	if err != nil {
+		return lhs, err
+	}
+
+	for {
+		t := self.peek()
+		if t.kind != tOp {
+			return lhs, nil
+		}
+
+		found := false
+		for _, op := range precedence[level] {
+			if t.text == op {
+				found = true
+			}
+		}
+
+		if !found {
+			return lhs, nil
+		}
+
+		self.next()
+
+		rhs, err := self.binary(level + 1)
+		if err != nil {
+			return rhs, err
+		}
+
+		if lhs, err = apply(t.text, lhs, rhs); err != nil {
+			return lhs, err
+		}
+	}
+}
+
+// apply does a binary operation; like C, the result is a plain integer no
+// matter how narrow the operands were
+func apply(op string, a, b value) (value, error) {
+	bool2int := func(b bool) int64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	r := value{}
+
+	switch op {
+	case "||":
+		r.n = bool2int(a.n != 0 || b.n != 0)
+	case "&&":
+		r.n = bool2int(a.n != 0 && b.n != 0)
+	case "|":
+		r.n = a.n | b.n
+	case "^":
+		r.n = a.n ^ b.n
+	case "&":
+		r.n = a.n & b.n
+	case "==":
+		r.n = bool2int(a.n == b.n)
+	case "!=":
+		r.n = bool2int(a.n != b.n)
+	case "<":
+		r.n = bool2int(a.n < b.n)
+	case "<=":
+		r.n = bool2int(a.n <= b.n)
+	case ">":
+		r.n = bool2int(a.n > b.n)
+	case ">=":
+		r.n = bool2int(a.n >= b.n)
+	case "<<":
+		r.n = a.n << uint(b.n)
+	case ">>":
+		r.n = a.n >> uint(b.n)
+	case "+":
+		r.n = a.n + b.n
+	case "-":
+		r.n = a.n - b.n
+	case "*":
+		r.n = a.n * b.n
+	case "/", "%":
+		if b.n == 0 {
+			return r, fmt.Errorf("division by zero")
+		}
+		if op == "/" {
+			r.n = a.n / b.n
+		} else {
+			r.n = a.n % b.n
+		}
+	}
+
+	return r, nil
+}
+
+func (self *parser) unary() (value, error) {
+	t := self.peek()
+	if t.kind != tOp {
+		return self.primary()
+	}
+
+	switch t.text {
+	case "-", "~", "!":
+		self.next()
+		v, err := self.unary()
+		if err != nil {
+			return v, err
+		}
+
+		switch t.text {
+		case "-":
+			v.n = -v.n
+			v.typ = nil
+		case "~":
+			v.n = extend(^v.n, v.typ)
+		case "!":
+			if v.n == 0 {
+				v.n = 1
+			} else {
+				v.n = 0
+			}
+			v.typ = nil
+		}
+		return v, nil
+
+	case "*":
+		self.next()
+
+		typ := scalarTypes["u8"]
+		if w := self.peek(); w.kind == tIdent {
+			if st, ok := scalarTypes[strings.ToLower(w.text)]; ok {
+				typ = st
+				self.next()
+			}
+		}
+
+		addr, err := self.unary()
+		if err != nil {
+			return addr, err
+		}
+
+		// pointers know what they point to
+		if addr.typ != nil && addr.typ.kind == pointerKind {
+			return self.ctx.load(addr.n, addr.typ.elem)
+		}
+
+		return self.ctx.readMem(addr.n, typ)
+
+	case "(":
+		if typ, ok := self.cast(); ok {
+			v, err := self.unary()
+			if err != nil {
+				return v, err
+			}
+
+			if typ.aggregate() {
+				return v, fmt.Errorf("can't cast to %s; try *(%s *)", typeName(typ), typeName(typ))
+			}
+
+			return value{n: extend(v.n, typ), typ: typ}, nil
+		}
+	}
+
+	return self.postfix()
+}
+
+// cast parses a type name in parentheses, if that's what's next; if it
+// isn't, it leaves the tokens where they were
+func (self *parser) cast() (*ctype, bool) {
+	start := self.pos
+	self.next()
+
+	words := []string{}
+	for self.peek().kind == tIdent {
+		words = append(words, self.next().text)
+	}
+
+	stars := ""
+	for self.accept("*") {
+		stars += "*"
+	}
+
+	if len(words) > 0 && self.accept(")") {
+		name := strings.Join(words, " ")
+		if _, isType := lookupType(name); isType || words[0] == "struct" || words[0] == "union" || typeWords[words[0]] {
+			if typ, err := parseTypeName(name + " " + stars); err == nil {
+				return typ, true
+			}
+		}
+	}
+
+	self.pos = start
+	return nil, false
+}
+
+// load reads a value of type typ at addr; structs and arrays stay in
+// memory, so their value is just the address
+func (self *evalContext) load(addr int64, typ *ctype) (value, error) {
+	switch {
+	case typ.aggregate():
+		return value{n: addr, typ: typ}, nil
+	case typ.size == 0:
+		return value{}, fmt.Errorf("can't read a %s", typeName(typ))
+	}
+
+	return self.readMem(addr, typ)
+}
+
+// postfix handles indexing and member access after a primary expression
+func (self *parser) postfix() (value, error) {
+	v, err := self.primary()
+	if err != nil {
+		return v, err
+	}
+
+	for {
+		t := self.peek()
+
+		switch {
+		case t.kind == tOp && t.text == "[":
+			self.next()
+
+			i, err := self.binary(0)
+			if err != nil {
+				return i, err
+			}
+
+			if !self.accept("]") {
+				return v, fmt.Errorf("missing ']'")
+			}
+
+			if v.typ == nil || (v.typ.kind != arrayKind && v.typ.kind != pointerKind) {
+				return v, fmt.Errorf("can only index arrays and pointers")
+			}
+
+			if v, err = self.ctx.load(v.n+i.n*int64(v.typ.elem.size), v.typ.elem); err != nil {
+				return v, err
+			}
+
+		case t.kind == tOp && t.text == "->":
+			self.next()
+
+			name := self.next()
+			if name.kind != tIdent {
+				return v, fmt.Errorf("expected a member name after '->'")
+			}
+
+			if v.typ == nil || v.typ.kind != pointerKind {
+				return v, fmt.Errorf("'->' needs a pointer")
+			}
+
+			if v, err = self.member(value{n: v.n, typ: v.typ.elem}, name.text); err != nil {
+				return v, err
+			}
+
+		// the lexer keeps dots in identifiers, so ".a.b" is one token
+		case t.kind == tIdent && strings.HasPrefix(t.text, "."):
+			self.next()
+
+			if v, err = self.member(v, t.text[1:]); err != nil {
+				return v, err
+			}
+
+		default:
+			return v, nil
+		}
+	}
+}
+
+// member finds a (maybe dotted) member of the struct or union v
+func (self *parser) member(v value, path string) (value, error) {
+	var err error
+
+	for _, name := range strings.Split(path, ".") {
+		if v.typ == nil || (v.typ.kind != structKind && v.typ.kind != unionKind) {
+			return v, fmt.Errorf("'.%s' needs a struct", name)
+		}
+
+		found := false
+		for _, f := range v.typ.fields {
+			if f.name == name {
+				if v, err = self.ctx.load(v.n+int64(f.off), f.typ); err != nil {
+					return v, err
+				}
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return v, fmt.Errorf("%s has no member %s", typeName(v.typ), name)
+		}
+	}
+
+	return v, nil
+}
+
+func (self *parser) primary() (value, error) {
+	t := self.next()
+
+	switch t.kind {
+	case tNum:
+		return value{n: t.n}, nil
+
+	case tIdent:
+		v, err := self.ident(t.text)
+		if err != nil {
+			return v, err
+		}
+
+		// r25:r24 is a pair; AVR pairs always have the higher register on
+		// top, so r24:r25 and r24:25 mean the same thing
+		if self.accept(":") {
+			lo := self.next()
+
+			name := lo.text
+			switch {
+			case lo.kind == tNum:
+				name = fmt.Sprintf("r%d", lo.n)
+			case lo.kind != tIdent:
+				return v, fmt.Errorf("expected a register after ':'")
+			}
+
+			lv, err := self.ident(name)
+			if err != nil {
+				return lv, err
+			}
+
+			hr, lr := regNumber(strings.TrimPrefix(t.text, "$")), regNumber(strings.TrimPrefix(name, "$"))
+			if hr != -1 && lr > hr {
+				v, lv = lv, v
+			}
+
+			return value{n: v.n<<8 | lv.n, typ: scalarTypes["u16"]}, nil
+		}
+
+		return v, nil
+
+	case tOp:
+		if t.text == "(" {
+			v, err := self.binary(0)
+			if err != nil {
+				return v, err
+			}
+
+			if !self.accept(")") {
+				return v, fmt.Errorf("missing ')'")
+			}
+
+			return v, nil
+		}
+
+		return value{}, fmt.Errorf("unexpected '%s'", t.text)
+	}
+
+	return value{}, fmt.Errorf("unexpected end of expression")
+}
+
+// regNumber returns n for "rN", or -1
+func regNumber(name string) int {
+	if len(name) < 2 || (name[0] != 'r' && name[0] != 'R') {
+		return -1
+	}
+
+	n, err := strconv.Atoi(name[1:])
+	if err != nil || n < 0 || n > 31 {
+		return -1
+	}
+
+	return n
+}
+
+// ident resolves a register, flag, or symbol name
+func (self *parser) ident(name string) (value, error) {
+	cpu := self.ctx.cpu
+	bare := strings.TrimPrefix(name, "$")
+	lower := strings.ToLower(bare)
+
+	u8, u16 := scalarTypes["u8"], scalarTypes["u16"]
+
+	if n := regNumber(bare); n != -1 {
+		return value{n: int64(cpu.reg(n)), typ: u8}, nil
+	}
+
+	switch lower {
+	case "x":
+		return value{n: int64(cpu.pair(26)), typ: u16}, nil
+	case "y":
+		return value{n: int64(cpu.pair(28)), typ: u16}, nil
+	case "z":
+		return value{n: int64(cpu.pair(30)), typ: u16}, nil
+	case "sp":
+		return value{n: int64(cpu.sp()), typ: u16}, nil
+	case "pc":
+		return value{n: int64(cpu.Pc), typ: u16}, nil
+	case "sreg":
+		return value{n: int64(cpu.sreg()), typ: u8}, nil
+	}
+
+	if strings.HasPrefix(lower, "sreg.") {
+		if bit, ok := flagBits[lower[5:]]; ok {
+			return value{n: int64(cpu.sreg()>>bit) & 1}, nil
+		}
+	}
+
+	if addr, ok := Listing.symdex[bare]; ok {
+		return value{n: int64(addr)}, nil
+	}
+
+	return value{}, fmt.Errorf("no register or symbol named '%s'", name)
+}
+
+// evaluate parses and evaluates src in ctx
+func evaluate(src string, ctx *evalContext) (value, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return value{}, err
+	}
+
+	p := &parser{toks: toks, ctx: ctx}
+
+	v, err := p.binary(0)
+	if err != nil {
+		return v, err
+	}
+
+	if t := p.peek(); t.kind != tEOF {
+		return v, fmt.Errorf("unexpected '%s'", t.text)
+	}
+
+	return v, nil
+}
+
+// format renders v in one of the "print" formats: x (hex), d (signed), u
+// (unsigned), c (character), t (binary), or 0 for the default of decimal
+// and hex together
+func format(v value, f byte) string {
+	size := v.size()
+	if size == 0 {
+		size = 2
+		if v.n > 0xffff || v.n < -0x8000 {
+			size = 4
+		}
+	}
+
+	if v.typ != nil && v.typ.kind == floatKind && f == 0 {
+		return fmt.Sprintf("%g", math.Float32frombits(uint32(v.n)))
+	}
+
+	bits := uint(size * 8)
+	u := uint64(v.n) & (1<<bits - 1)
+
+	switch f {
+	case 'x':
+		return fmt.Sprintf("0x%0*x", size*2, u)
+	case 'd':
+		return fmt.Sprintf("%d", v.n)
+	case 'u':
+		return fmt.Sprintf("%d", u)
+	case 'c':
+		if u >= 32 && u < 127 {
+			return fmt.Sprintf("%d '%c'", u, rune(u))
+		}
+		return fmt.Sprintf("%d '\\x%0.2x'", u, u&0xff)
+	case 't':
+		return fmt.Sprintf("%0*b", bits, u)
+	}
+
+	return fmt.Sprintf("%d (0x%0*x)", v.n, size*2, u)
+}
+
+// printExpr is the "print" command; line is everything after "print", and
+// f is the format suffix, if there was one. It returns false if there was
+// nothing to print.
+func printExpr(line string, f byte) bool {
+	if line == "" {
+		logf("print[/x|/d|/u|/c|/t] <expr>")
+		return false
+	}
+
+	ctx, err := liveContext()
+	if err != nil {
+		logError("print", err)
+		return false
+	}
+
+	v, err := evaluate(line, ctx)
+	if err != nil {
+		logf("can't evaluate '%s': %s", line, err)
+		return false
+	}
+
+	logf("%s = %s", line, ctx.describe(v, f))
+	return true
+}
+
+// describe is format for any value, reading structs and arrays from the
+// context's memory
+func (self *evalContext) describe(v value, f byte) string {
+	switch {
+	case v.typ != nil && v.typ.aggregate():
+		blob, err := self.read(uint16(v.n), v.typ.size)
+		if err != nil {
+			return fmt.Sprintf("<%s>", err)
+		}
+		return formatBytes(v.typ, blob, f)
+	case v.typ != nil && v.typ.kind == pointerKind:
+		return fmt.Sprintf("(%s) 0x%0.4x", typeName(v.typ), v.n)
+	}
+
+	return format(v, f)
+}
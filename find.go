@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Memory search. "find <start> <end> <pattern>" scans start through end
+// (inclusive) for a pattern made of any mix of:
+//
+//   de ad be ef, deadbeef   hex bytes
+//   ??                      any byte (also inside hex, like de??ef)
+//   "flag{"                 ASCII, with Go escapes
+//   u16:1234                a little-endian word (hex; 0d for decimal)
+//
+// and logs every hit with the nearest symbol.
+
+const (
+	// findChunk is the most peek will give us at once
+	findChunk = 2048
+
+	// findMax is the most hits we'll log
+	findMax = 256
+)
+
+// patByte is a byte of a pattern; wild matches anything
+type patByte struct {
+	b    byte
+	wild bool
+}
+
+// parsePattern turns the pattern part of a find command into bytes
+func parsePattern(src string) (pat []patByte, err error) {
+	src = strings.TrimSpace(src)
+
+	for len(src) > 0 {
+		var tok string
+
+		if src[0] == '"' {
+			// find the closing quote, skipping escaped ones
+			end := 1
+			for ; end < len(src) && src[end] != '"'; end++ {
+				if src[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(src) {
+				return nil, fmt.Errorf("missing closing quote")
+			}
+
+			text, err := strconv.Unquote(src[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad string %s", src[:end+1])
+			}
+
+			for i := 0; i < len(text); i++ {
+				pat = append(pat, patByte{b: text[i]})
+			}
+
+			src = strings.TrimSpace(src[end+1:])
+			continue
+		}
+
+		if i := strings.IndexAny(src, " \t"); i != -1 {
+			tok, src = src[:i], strings.TrimSpace(src[i:])
+		} else {
+			tok, src = src, ""
+		}
+
+		if strings.HasPrefix(tok, "u16:") {
+			n, ok := locNumber(tok[4:])
+			if !ok {
+				return nil, fmt.Errorf("bad u16 '%s'", tok[4:])
+			}
+			pat = append(pat, patByte{b: byte(n)}, patByte{b: byte(n >> 8)})
+			continue
+		}
+
+		if len(tok)%2 != 0 {
+			return nil, fmt.Errorf("odd number of hex digits in '%s'", tok)
+		}
+
+		for i := 0; i < len(tok); i += 2 {
+			if tok[i:i+2] == "??" {
+				pat = append(pat, patByte{wild: true})
+				continue
+			}
+
+			b, err := strconv.ParseUint(tok[i:i+2], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("bad hex '%s'", tok)
+			}
+			pat = append(pat, patByte{b: byte(b)})
+		}
+	}
+
+	if len(pat) == 0 {
+		return nil, fmt.Errorf("empty pattern")
+	}
+
+	return pat, nil
+}
+
+func matchAt(blob []byte, pat []patByte) bool {
+	for i, p := range pat {
+		if !p.wild && blob[i] != p.b {
+			return false
+		}
+	}
+	return true
+}
+
+// findPattern scans start through end for pat, a chunk at a time; chunks
+// overlap so that hits across a boundary aren't missed
+func findPattern(start, end int, pat []patByte) (hits []int, err error) {
+	for addr := start; addr+len(pat)-1 <= end; {
+		size := findChunk
+		if addr+size > end+1 {
+			size = end + 1 - addr
+		}
+
+		blob := peek(uint16(addr), size)
+		if len(blob) < len(pat) {
+			return hits, fmt.Errorf("can't read %0.4x", addr)
+		}
+
+		for i := 0; i+len(pat) <= len(blob); i++ {
+			if matchAt(blob[i:], pat) {
+				hits = append(hits, addr+i)
+			}
+		}
+
+		if addr+len(blob) > end {
+			break
+		}
+		addr += len(blob) - len(pat) + 1
+	}
+
+	return hits, nil
+}
+
+func findCommand(toks []string) bool {
+	if len(toks) < 4 {
+		logf("find <start> <end> <pattern>; pattern is hex (de ad ?? ef), \"text\", u16:1234")
+		return false
+	}
+
+	start, err := locate(toks[1], dataLoc)
+	if err != nil {
+		logf("%s", err)
+		return false
+	}
+
+	end, err := locate(toks[2], dataLoc)
+	if err != nil {
+		logf("%s", err)
+		return false
+	}
+
+	if end < start {
+		logf("end %0.4x is before start %0.4x", end, start)
+		return false
+	}
+
+	pat, err := parsePattern(strings.Join(toks[3:], " "))
+	if err != nil {
+		logf("%s", err)
+		return false
+	}
+
+	hits, err := findPattern(start, end, pat)
+	if err != nil {
+		logf("%s", err)
+	}
+
+	for i, addr := range hits {
+		if i == findMax {
+			logf("... and %d more", len(hits)-i)
+			break
+		}
+
+		logf("%0.4x <%s>", addr, Listing.symbolize(addr))
+	}
+
+	logf("%d hits in %0.4x-%0.4x", len(hits), start, end)
+	return true
+}
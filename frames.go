@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Stack unwinding. There's no debug info, so there are two ways to find the
+// call frames on the stack:
+//
+// The dumb way ("bt") walks up from SP and treats every word that points
+// just after a CALL/RCALL/ICALL in the listing as a return address. It
+// doesn't care what compiler built the code, but it gets fooled by stale
+// return addresses left in locals.
+//
+// The frame-pointer way ("bt fp") reads each function's avr-gcc prologue
+// to learn which registers it pushed and how many bytes of locals it
+// reserved below Y, and computes exactly where the return address has to
+// be; the saved r28/r29 in each frame give us the caller's Y.
+
+const (
+	// btScan is how many bytes above SP the dumb unwinder walks
+	btScan = 512
+
+	// btFrames is the most frames we'll report
+	btFrames = 32
+
+	// prologueMax is how many instructions into a function we'll look for
+	// its prologue
+	prologueMax = 32
+
+	// ioSPL is the I/O address of the low byte of SP
+	ioSPL = 0x3d
+)
+
+// frame is one call frame on the stack
+type frame struct {
+	pc    int            // where it's executing; a return address for all but #0
+	retAt uint16         // where its return address is stored, or 0 if we didn't find one
+	saved map[uint16]int // stack addresses of registers its prologue pushed
+}
+
+func (self *frame) String() string {
+	return fmt.Sprintf("0x%0.4x <%s>", self.pc, Listing.symbolize(self.pc))
+}
+
+// stackMem caches a chunk of the stack so the unwinders don't peek a byte
+// at a time
+type stackMem struct {
+	addr  uint16
+	bytes []byte
+}
+
+func (self *stackMem) at(addr uint16) (uint8, bool) {
+	if addr >= self.addr && int(addr-self.addr) < len(self.bytes) {
+		return self.bytes[addr-self.addr], true
+	}
+
+	b := peek(addr, 1)
+	if b == nil {
+		return 0, false
+	}
+
+	return b[0], true
+}
+
+// ret reads a return address stored at addr; CALL pushes the low byte
+// first, so the high byte ends up at the lower address
+func (self *stackMem) ret(addr uint16) (int, bool) {
+	hi, ok := self.at(addr)
+	if !ok {
+		return 0, false
+	}
+
+	lo, ok := self.at(addr + 1)
+	if !ok {
+		return 0, false
+	}
+
+	return Listing.codeAddr(int(hi)<<8 | int(lo)), true
+}
+
+// prologue is what we learn about a function's frame from its first few
+// instructions
+type prologue struct {
+	pushes []int // registers pushed, in order
+	locals int   // bytes reserved below the pushes
+	fp     bool  // copies SP into Y
+}
+
+// analyze reads the prologue of the function starting at fn, stopping at pc
+// so that we only count what has actually run
+func analyze(fn, pc int) (pro prologue) {
+	line, ok := Listing.lindex[fn]
+	if !ok {
+		return
+	}
+
+	lo := 0
+
+	for i := line; i < len(Listing.program) && i < line+prologueMax; i++ {
+		insn := &Listing.program[i]
+		if insn.Offset >= pc {
+			return
+		}
+
+		switch strings.ToUpper(insn.Opcode) {
+		case "PUSH":
+			pro.pushes = append(pro.pushes, insn.Src)
+		case "RCALL":
+			// avr-gcc reserves small frames with "rcall .+0"
+			if insn.K != 0 {
+				return
+			}
+			pro.locals += 2
+		case "IN":
+			if insn.K == ioSPL || insn.Src == ioSPL {
+				pro.fp = true
+			}
+		case "SBIW":
+			pro.locals += insn.K
+		case "SUBI":
+			lo = insn.K
+		case "SBCI":
+			pro.locals += insn.K<<8 | lo
+			lo = 0
+		case "OUT", "CLI", "EOR", "CLR":
+		default:
+			return
+		}
+	}
+
+	return
+}
+
+// backtrace unwinds the stack for the CPU state in cpu, the dumb way or
+// the frame-pointer way
+func backtrace(cpu *ApuState, fp bool) []frame {
+	sp := cpu.sp()
+	mem := &stackMem{addr: sp + 1, bytes: peek(sp+1, btScan)}
+
+	if fp {
+		return unwind(cpu, mem)
+	}
+
+	return scanFrames(cpu, mem)
+}
+
+func scanFrames(cpu *ApuState, mem *stackMem) []frame {
+	frames := []frame{{pc: cpu.Pc}}
+
+	for i := 0; i+1 < len(mem.bytes) && len(frames) < btFrames; i++ {
+		at := mem.addr + uint16(i)
+		ret, _ := mem.ret(at)
+		if !isReturn(ret) {
+			continue
+		}
+
+		frames[len(frames)-1].retAt = at
+		frames = append(frames, frame{pc: ret})
+		i++
+	}
+
+	return frames
+}
+
+func unwind(cpu *ApuState, mem *stackMem) (frames []frame) {
+	sp, y, pc := cpu.sp(), cpu.pair(28), cpu.Pc
+
+	for len(frames) < btFrames {
+		f := frame{pc: pc, saved: map[uint16]int{}}
+
+		fn, ok := Listing.symbolAt(pc)
+		if !ok {
+			return append(frames, f)
+		}
+
+		pro := analyze(fn.addr, pc)
+
+		bottom := sp
+		if pro.fp {
+			bottom = y
+		}
+
+		retAt := bottom + uint16(pro.locals+len(pro.pushes)) + 1
+		for j, r := range pro.pushes {
+			f.saved[retAt-1-uint16(j)] = r
+		}
+
+		ret, ok := mem.ret(retAt)
+		if !ok || !isReturn(ret) {
+			return append(frames, f)
+		}
+
+		f.retAt = retAt
+		frames = append(frames, f)
+
+		// the caller's Y is whatever this frame's prologue saved
+		ylo, yhi := -1, -1
+		for at, r := range f.saved {
+			switch r {
+			case 28:
+				if b, ok := mem.at(at); ok {
+					ylo = int(b)
+				}
+			case 29:
+				if b, ok := mem.at(at); ok {
+					yhi = int(b)
+				}
+			}
+		}
+
+		if ylo != -1 && yhi != -1 {
+			y = uint16(yhi<<8 | ylo)
+		}
+
+		sp = retAt + 1
+		pc = ret
+	}
+
+	return
+}
+
+// printBacktrace logs the frames for the current CPU state
+func printBacktrace(fp bool) {
+	stat, err := fetchStatus()
+	if err != nil {
+		logError("bt", err)
+		return
+	}
+
+	frames := backtrace(&stat.Cpu, fp)
+
+	for i, f := range frames {
+		if f.retAt != 0 {
+			logf("#%d %s  (return address at %0.4x)", i, f.String(), f.retAt)
+		} else {
+			logf("#%d %s", i, f.String())
+		}
+
+		if fp && len(f.saved) > 0 {
+			addrs := []int{}
+			for at := range f.saved {
+				addrs = append(addrs, int(at))
+			}
+			sort.Sort(sort.Reverse(sort.IntSlice(addrs)))
+
+			regs := []string{}
+			for _, at := range addrs {
+				regs = append(regs, fmt.Sprintf("r%d@%0.4x", f.saved[uint16(at)], at))
+			}
+			logf("     saved %s", strings.Join(regs, " "))
+		}
+	}
+
+	logf("")
+}
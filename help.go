@@ -25,34 +25,16 @@ func (self *help) draw(v *gocui.View, refresh bool) {
 		return
 	}
 
-	v.Write([]byte(self.contents))
+	// the keys come from the keymap, which can change
+	v.Write([]byte(keymapHelp() + self.contents))
 
 	self.written = true
 }
 
 func (self *help) init() {
 	self.contents = `
-TAB switches tabs. PgUp/PgDown scrolls main window.
-
-C-d                     Scroll down assembly
-C-u                     Scroll up assembly
-Left                    Center assembly on current instruction
-Up                      Command history up
-Down                    Command history down
-C-x                     Enter hotkey mode, and then:
-  S                     Start device
-  s                     Stop/step device
-  c                     Continue device
-  R                     Restart device
-C-b                     Bump stack
-
-C-Q                     Log view
-C-W                     Device output view
-C-E                     Source view
-C-R                     VM opcode view
-C-T                     Memory view
-C-Y                     Stack view
-C-H                     Help
+Mouse: click a listing line to toggle a breakpoint, or a jump's operands to
+go to its target; click a tab name to switch to it; the wheel scrolls.
 
 Debugger commands:
 
@@ -66,15 +48,106 @@ restart                 Restart device
 break <arg>             Set breakpoint on <arg> (addr/fn)
 clear <arg>             Clear breakpoint on <arg> (addr/fn)
 runto <arg>             Execute instructions until <arg> 
-stepover                If at CALL, run until that function returns
+stepover / next         If at CALL, run until that function returns
+finish                  Run until the current function returns
+until <arg>             Run to <arg>, or until the current function returns
+bt                      Backtrace: return addresses found on the stack
+bt fp                   Backtrace using avr-gcc prologues and Y frame pointer
 follow / nofollow       Assembly listing does / doesn't follow PC
 dump <addr>             Load <addr> into memory dump
-
-r/8 r24                 Display value of r24
-r/16 r24:25             Display word in r24:25
+goto <addr>             Move the memory view's cursor to <addr>
+dump group <1|2|4>      Group bytes in the memory view
+dump follow / back      Jump to the pointer at the cursor / go back
+snapshot save <name>    Save all 64K of memory as <name>
+snapshot diff <a> [b]   List regions that differ between snapshots (or live)
+snapshot list / del     List or delete snapshots
+                        (the memory view highlights bytes that changed
+                        since the PC last moved)
+theme dark / light      Switch color themes (dark is the default)
+theme off               No colors
+theme load <file>       Load "role: attributes" lines over the current theme
+                        ...theme.cfg is loaded at startup if it's there
+theme                   Show the roles in their current colors
+keys                    List key bindings
+keys load <file>        Load bindings from <file> (keys.cfg is loaded at startup)
+bind <key>: <action>    Bind <key> ([modal] [@tab] <key>) to a command or UI action
+unbind <key>            Remove a binding
+split [tab]             Split the main area, showing [tab] in a new pane
+unsplit / only          Close the focused pane / all the others
+pane next|<n>           Focus the next pane, or pane <n>
+pane grow|shrink [n]    Resize the focused pane
+layout rows|cols        Stack panes in rows or put them side by side
+layout listing <pct>    Give the listing <pct> percent of the screen
+layout save <name>      Save the layout in layouts.cfg as <name>
+layout <name>           Switch layouts ("default", "debug", or saved ones)
+layout [del <name>]     Show the layout and saved names, or delete one
+history [n]             Show the last [n] commands, numbered (kept in ~/.debugger_history)
+history clear           Forget all of them
+!! / !n / !prefix       Run the last command, command n, or the last starting with prefix
+<name> [args]           Run a macro; $1..$9, $@ and $# are its arguments
+define <name>           Define a macro: commands, one or more per line, then end
+define <name>: <cmds>   Define a one-line macro (commands separated by ;)
+                        ...in macros, "local x = <expr>" sets $x, and there's
+                        if <expr> ... [else ...] end, while <expr> ... end
+                        and repeat <expr> ... end (these work here too)
+macros                  List macros
+macro show|del <name>   Show a macro indented, or delete it
+macro edit <name>       Put a macro on the command line to edit
+macro save [file]       Write macros to [file] (macros.cmd, which is
+                        reloaded when it changes)
+source [-e] <file>      Run the commands in <file>; -e stops at the first one that fails
+                        (~/.debuggerrc and ./.debuggerrc are run once the listing loads)
+output [mode]           Show device output raw, through a VT100 (term),
+                        with unprintables spelled out (escaped), or as hex
+find <start> <end> <pat>
+                        Search memory for <pat>: hex (de ad ?? ef),
+                        "text", u16:1234, or a mix
+watch <addr> [len]      Stop when <len> bytes at <addr> are written
+rwatch <addr> [len]     Stop when they're read
+awatch <addr> [len]     Stop when they're read or written
+unwatch <n|all>         Delete watchpoint(s)
+watchpoints             List all watchpoints
+                        (with watchpoints set, cont single-steps; step stops)
+trace start / stop      Record every state we see into the trace tab
+                        (while tracing, runto single-steps so every
+                        instruction on the way is recorded)
+trace size <n>          Keep the last <n> states (default 500)
+trace save <file>       Write the trace to <file> (or: save trace <file>)
+rstep [n]               Show the state <n> recorded steps back (no device I/O)
+rcontinue               Go back through recorded states to a breakpoint
+goto-history <n|live>   Show recorded state #<n>, or the live device again
+
+Addresses (break, clear, list, runto, until, dump, goto, find, watch, x) can be:
+  1234, 0x1234          Hex; 0d4660 is decimal
+  main, &main           A symbol (&main if the name also looks like hex)
+  main+10, $pc-4        Plus or minus hex offsets
+  $pc, $sp              Current PC or stack pointer
+  *X, *Y, *Z            Address in a pointer register
+  ret                   Return address of the current function
+
+x/NFU <loc>             Examine memory: N units (b, h, w: 1, 2, 4 bytes,
+                        little-endian) as F (x, d, u, t, c, s strings,
+                        i instructions); all optional, F and U sticky
+x/16xh @Y+4             ...at the address in an expression (@r25:r24 etc)
+x/8i $pc                ...8 instructions from the PC
+x                       ...carry on from where the last one stopped
+r/8 r24                 Display value of r24 (r/16 r24:25 for a pair)
 r/s @r24:25             Read string in memory pointed to at r24:r25
-r/m @r24                Dump memory pointed to by r24:r25
-r/m @4000               Dump memory at 0x4000
+r/m @4000               Dump 32 bytes at 0x4000 (r/8, r/16 also work)
+print <expr>            Evaluate <expr>: registers (r24, r25:r24, X, Y, Z,
+                        SP, PC, SREG, SREG.Z), symbols, C operators, and
+                        memory (*u8, *s8, *u16, *s16, *u32, *s32 <addr>)
+print/x <expr>          ...in hex (also /d, /u, /c, /t); "p" for short
+print *(struct foo *)0x240
+                        ...with C types loaded from a header; also p->x,
+                        s.x, a[i], and casts like (uint16_t)r24
+types load <file>       Load struct, union and typedef declarations
+types                   List loaded types
+ptype <type|expr>       Show a type's members and offsets
+dump as <type|hex>      Show memory at the cursor as <type>, or as hex again
+display <expr>          Show <expr> in the watch tab, updated at every stop
+display                 List displayed expressions
+undisplay <n|all>       Stop displaying expression(s)
 
 load <file>             Load C source from <file>
 compile                 Compile loaded C source
@@ -0,0 +1,141 @@
+package main
+
+import "fmt"
+
+// Reverse stepping. We can't run the emulator backwards, but we can look at
+// the states the trace recorded: the history cursor points at a trace
+// entry, and while it's set the status bar, listing, dump and stack tabs
+// show that entry instead of the live device. Nothing here talks to the
+// device; any command that does (step, cont, runto...) drops us back to
+// live.
+
+type history struct {
+	cursor int // sequence number of the trace entry we're showing; 0 is live
+}
+
+// active is true if we're showing a recorded state instead of the device
+func (self *history) active() bool {
+	return self.cursor != 0
+}
+
+// entry returns the trace entry under the cursor, or nil if we're live
+func (self *history) entry() *traceEntry {
+	if self.cursor == 0 {
+		return nil
+	}
+
+	return Trace.find(self.cursor)
+}
+
+func (self *history) goTo(n int) {
+	if Trace.find(n) == nil {
+		first, last := Trace.bounds()
+		logf("no state #%d in the trace (have %d-%d)", n, first, last)
+		return
+	}
+
+	self.cursor = n
+	self.show()
+}
+
+// live goes back to showing the device
+func (self *history) live() {
+	if !self.active() {
+		return
+	}
+
+	self.cursor = 0
+	Trace.redraw()
+
+	Listing.deliver(event{kind: LIST_ADDR, addr: CurrentStatus.stat.Cpu.Pc})
+	Dump.deliver(event{kind: HISTORY})
+	Stack.deliver(event{kind: HISTORY})
+	Watches.deliver(event{kind: HISTORY})
+	Regs.deliver(event{kind: HISTORY})
+	updateStatus()
+
+	logf("showing live device")
+}
+
+// start returns the sequence number to move backwards from
+func (self *history) start() (cur int, ok bool) {
+	_, last := Trace.bounds()
+	if last == 0 {
+		logf("nothing recorded; 'trace start' first")
+		return
+	}
+
+	if self.cursor == 0 {
+		return last, true
+	}
+
+	return self.cursor, true
+}
+
+// back moves the cursor n states into the past
+func (self *history) back(n int) {
+	cur, ok := self.start()
+	if !ok {
+		return
+	}
+
+	first, _ := Trace.bounds()
+
+	cur -= n
+	if cur < first {
+		cur = first
+		logf("at the start of recorded history")
+	}
+
+	self.goTo(cur)
+}
+
+// rcontinue moves backwards until we find a state at a breakpoint, or run
+// out of history
+func (self *history) rcontinue() {
+	cur, ok := self.start()
+	if !ok {
+		return
+	}
+
+	first, _ := Trace.bounds()
+	bps := allBreakpoints()
+
+	for n := cur - 1; n >= first; n-- {
+		e := Trace.find(n)
+		if e == nil {
+			break
+		}
+
+		for _, bp := range bps {
+			if uint16(e.pc) == bp {
+				logf("breakpoint at %0.4x", bp)
+				self.goTo(n)
+				return
+			}
+		}
+	}
+
+	logf("at the start of recorded history")
+	self.goTo(first)
+}
+
+// show points every view at the entry under the cursor
+func (self *history) show() {
+	e := self.entry()
+	if e == nil {
+		return
+	}
+
+	first, last := Trace.bounds()
+
+	CurrentStatus.render(e.stat(), fmt.Sprintf("HISTORY #%d [%d-%d] ", e.n, first, last))
+	Listing.deliver(event{kind: LIST_ADDR, addr: e.pc})
+	Dump.deliver(event{kind: HISTORY})
+	Stack.deliver(event{kind: HISTORY})
+	Watches.deliver(event{kind: HISTORY})
+	Regs.deliver(event{kind: HISTORY})
+
+	Trace.redraw()
+	logf("#%s", e.String())
+}
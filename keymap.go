@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jroimartin/gocui"
+)
+
+// Keymap. Every key (besides Tab and C-c) is looked up here, and the help
+// tab is drawn from it. The defaults below are in the same format as
+// "keys.cfg", which is loaded over them at startup if it's in the current
+// directory:
+//
+//   [modal] [@tab] <key>: <action>  # help text
+//
+// "modal" bindings only work in hotkey mode (C-x), and "@dump" ones only
+// when the dump tab is showing; the most specific binding wins. A plain
+// character can only be a hotkey, since otherwise you're typing. The
+// action is one of the UI actions in uiActions, or else a debugger
+// command.
+
+const defaultKeymap = `
+Esc: hotkeys                    # Switch between command line and hotkey mode
+C-x: hotkeys                    # Switch between command line and hotkey mode
+Enter: enter                    # Run the command line
+Up: history-up                  # Command history up
+Down: history-down              # Command history down
+C-r: history-search             # Search command history
+Left: list-center               # Center assembly on current instruction
+Right: scroll-bottom            # Scroll main window to the bottom
+PgUp: scroll-up                 # Scroll main window up
+PgDn: scroll-down               # Scroll main window down
+C-d: list-down                  # Scroll down assembly
+C-u: list-up                    # Scroll up assembly
+C-b: bump                       # Bump stack
+C-q: show log                   # Log view
+C-w: show output                # Device output view
+C-e: show source                # Source view
+C-v: show vm                    # VM opcode view
+C-t: show dump                  # Memory view
+C-y: show stack                 # Stack view
+F1: show help                   # Help
+C-o: pane next                  # Focus the next pane
+
+modal S: start                  # Start device
+modal s: step                   # Stop/step device
+modal c: continue               # Continue device
+modal R: restart                # Restart device
+modal u: update                 # Update status
+modal h: show help              # Help
+modal Up: scroll-up             # Scroll main window up
+modal Down: scroll-down         # Scroll main window down
+modal o: pane next              # Focus the next pane
+modal +: pane grow              # Make the focused pane bigger
+modal -: pane shrink            # Make the focused pane smaller
+modal f: dump follow            # In memory view: follow pointer at cursor
+modal b: dump back              # In memory view: go back
+modal @dump Up: cursor up       # Move the cursor
+modal @dump Down: cursor down   # Move the cursor
+modal @dump Left: cursor left   # Move the cursor
+modal @dump Right: cursor right # Move the cursor
+`
+
+type keyBinding struct {
+	key    string // canonical name, from keyNames, or a character
+	modal  bool   // only in hotkey mode
+	tab    string // only when this tab is showing
+	action string
+	help   string
+}
+
+// same is true if o is bound in the same place
+func (self *keyBinding) same(o *keyBinding) bool {
+	return self.key == o.key && self.modal == o.modal && self.tab == o.tab
+}
+
+func (self *keyBinding) where() string {
+	s := self.key
+	if self.tab != "" {
+		s += " (" + self.tab + ")"
+	}
+	return s
+}
+
+// keymap is in the order bindings were made; later ones replace earlier
+// ones in the same place. Keys are looked up on the gocui goroutine and
+// bound by commands, so it's locked.
+var (
+	keymap     []*keyBinding
+	keymapLock sync.Mutex
+)
+
+var keyNames = map[string]gocui.Key{
+	"Esc": gocui.KeyEsc, "Enter": gocui.KeyEnter, "Space": gocui.KeySpace,
+	"Up": gocui.KeyArrowUp, "Down": gocui.KeyArrowDown,
+	"Left": gocui.KeyArrowLeft, "Right": gocui.KeyArrowRight,
+	"PgUp": gocui.KeyPgup, "PgDn": gocui.KeyPgdn,
+	"Home": gocui.KeyHome, "End": gocui.KeyEnd,
+	"Insert": gocui.KeyInsert, "Delete": gocui.KeyDelete,
+	"F1": gocui.KeyF1, "F2": gocui.KeyF2, "F3": gocui.KeyF3, "F4": gocui.KeyF4,
+	"F5": gocui.KeyF5, "F6": gocui.KeyF6, "F7": gocui.KeyF7, "F8": gocui.KeyF8,
+	"F9": gocui.KeyF9, "F10": gocui.KeyF10, "F11": gocui.KeyF11, "F12": gocui.KeyF12,
+}
+
+func init() {
+	// C-a through C-z, less C-c (quit), C-i (Tab) and C-m (Enter). C-h is
+	// backspace on a lot of terminals, so think twice before binding it.
+	for c := 'a'; c <= 'z'; c++ {
+		switch c {
+		case 'c', 'i', 'm':
+			continue
+		}
+		keyNames["C-"+string(c)] = gocui.KeyCtrlA + gocui.Key(c-'a')
+	}
+}
+
+// keyName returns the keymap's name for a key gocui gave us
+func keyName(kv interface{}) string {
+	if r, ok := kv.(rune); ok {
+		return string(r)
+	}
+
+	for name, k := range keyNames {
+		if k == kv {
+			return name
+		}
+	}
+	return ""
+}
+
+// keyValue returns what to give gocui for a key name
+func keyValue(name string) (interface{}, error) {
+	if k, ok := keyNames[name]; ok {
+		return k, nil
+	}
+
+	if r := []rune(name); len(r) == 1 && r[0] > ' ' && r[0] < 127 {
+		return r[0], nil
+	}
+
+	return nil, fmt.Errorf("unknown key '%s'", name)
+}
+
+// parseBinding parses "[modal] [@tab] key: action # help"; the action is
+// empty for "unbind"
+func parseBinding(line string) (*keyBinding, error) {
+	b := &keyBinding{}
+
+	spec, rest := line, ""
+	if i := strings.Index(line, ":"); i != -1 {
+		spec, rest = line[:i], line[i+1:]
+	}
+
+	if i := strings.Index(rest, "#"); i != -1 {
+		b.help = strings.TrimSpace(rest[i+1:])
+		rest = rest[:i]
+	}
+	b.action = strings.TrimSpace(rest)
+
+	toks := strings.Fields(spec)
+	if len(toks) == 0 {
+		return nil, fmt.Errorf("no key")
+	}
+
+	for _, tok := range toks[:len(toks)-1] {
+		switch {
+		case tok == "modal":
+			b.modal = true
+		case strings.HasPrefix(tok, "@"):
+			b.tab = tok[1:]
+		default:
+			return nil, fmt.Errorf("expected \"modal\" or \"@tab\", not '%s'", tok)
+		}
+	}
+
+	b.key = toks[len(toks)-1]
+	v, err := keyValue(b.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := v.(rune); ok {
+		b.modal = true
+	}
+
+	return b, nil
+}
+
+// without returns km less the binding in b's place, and whether there was
+// one; km isn't changed
+func without(km []*keyBinding, b *keyBinding) ([]*keyBinding, bool) {
+	out := make([]*keyBinding, 0, len(km)+1)
+	found := false
+	for _, o := range km {
+		if o.same(b) {
+			found = true
+			continue
+		}
+		out = append(out, o)
+	}
+	return out, found
+}
+
+// bind adds bs to the keymap, replacing whatever was in their places, and
+// tells gocui about their keys if they're new
+func bind(bs ...*keyBinding) {
+	keymapLock.Lock()
+	km := keymap
+	for _, b := range bs {
+		km, _ = without(km, b)
+		km = append(km, b)
+	}
+	keymap = km
+	keymapLock.Unlock()
+
+	Help.written = false
+
+	if g != nil {
+		g.Execute(func(g *gocui.Gui) error {
+			for _, b := range bs {
+				bindKey(b.key)
+			}
+			return nil
+		})
+	}
+}
+
+// unbind removes the binding in b's place, returning whether there was one
+func unbind(b *keyBinding) bool {
+	keymapLock.Lock()
+	defer keymapLock.Unlock()
+
+	km, found := without(keymap, b)
+	if found {
+		keymap = km
+		Help.written = false
+	}
+	return found
+}
+
+// currentKeymap returns a copy of the keymap, to look through without
+// holding the lock
+func currentKeymap() []*keyBinding {
+	keymapLock.Lock()
+	defer keymapLock.Unlock()
+
+	return append([]*keyBinding{}, keymap...)
+}
+
+// loadKeymap reads bindings from text, one per line. Nothing changes unless
+// every line is good, so a mistake can't leave half a file bound.
+func loadKeymap(name, text string) error {
+	bs := []*keyBinding{}
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		b, err := parseBinding(line)
+		if err == nil && b.action == "" {
+			err = fmt.Errorf("no action")
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", name, i+1, err)
+		}
+
+		bs = append(bs, b)
+	}
+
+	bind(bs...)
+	return nil
+}
+
+// lookupKey finds the binding for key given the mode and tab we're in
+func lookupKey(key string) *keyBinding {
+	keymapLock.Lock()
+	defer keymapLock.Unlock()
+
+	var best *keyBinding
+	score := -1
+
+	for _, b := range keymap {
+		if b.key != key || (b.modal && modal != 1) || (b.tab != "" && b.tab != Tabbar.current()) {
+			continue
+		}
+
+		s := 0
+		if b.tab != "" {
+			s += 2
+		}
+		if b.modal {
+			s++
+		}
+
+		if s >= score {
+			best, score = b, s
+		}
+	}
+
+	return best
+}
+
+type uiAction struct {
+	help string
+	run  func(v *gocui.View, arg string)
+}
+
+// uiActions are the things a key can do besides run a command (they're
+// filled in by init, since they refer to the tabs, which refer back here)
+var uiActions map[string]uiAction
+
+func init() {
+	uiActions = map[string]uiAction{
+		"hotkeys": {"Switch between command line and hotkey mode", func(v *gocui.View, arg string) {
+			switchMode(v)
+		}},
+		"enter": {"Run the command line", func(v *gocui.View, arg string) {
+			CommandLine.deliver(event{kind: FLUSH})
+		}},
+		"history-up": {"Command history up", func(v *gocui.View, arg string) {
+			CommandLine.deliver(event{kind: HIST_UP})
+		}},
+		"history-down": {"Command history down", func(v *gocui.View, arg string) {
+			CommandLine.deliver(event{kind: HIST_DOWN})
+		}},
+		"history-search": {"Search command history", func(v *gocui.View, arg string) {
+			if modal == 1 {
+				return
+			}
+			cmdline, _ := g.View("cmdline")
+			CommandLine.search(cmdline)
+		}},
+		"list-up": {"Scroll up assembly", func(v *gocui.View, arg string) {
+			Listing.deliver(event{kind: LIST_UP})
+		}},
+		"list-down": {"Scroll down assembly", func(v *gocui.View, arg string) {
+			Listing.deliver(event{kind: LIST_DOWN})
+		}},
+		"list-center": {"Center assembly on current instruction", func(v *gocui.View, arg string) {
+			Listing.deliver(event{kind: LIST_CENTER})
+		}},
+		"scroll-up": {"Scroll main window up", func(v *gocui.View, arg string) {
+			Tabbar.up()
+		}},
+		"scroll-down": {"Scroll main window down", func(v *gocui.View, arg string) {
+			Tabbar.down()
+		}},
+		"scroll-bottom": {"Scroll main window to the bottom", func(v *gocui.View, arg string) {
+			Tabbar.bottom()
+		}},
+		"next-tab": {"Next tab", func(v *gocui.View, arg string) {
+			Tabbar.nextTab()
+			redraw()
+		}},
+		"show": {"Switch to a tab", func(v *gocui.View, arg string) {
+			Tabbar.switchTo(arg)
+		}},
+		"cursor": {"Move the memory view's cursor", func(v *gocui.View, arg string) {
+			switch arg {
+			case "down":
+				Dump.deliver(event{kind: DUMP_MOVE, addr: 1, data: "line"})
+			case "up":
+				Dump.deliver(event{kind: DUMP_MOVE, addr: -1, data: "line"})
+			case "right":
+				Dump.deliver(event{kind: DUMP_MOVE, addr: 1})
+			case "left":
+				Dump.deliver(event{kind: DUMP_MOVE, addr: -1})
+			}
+		}},
+	}
+}
+
+// runAction does what a binding says
+func runAction(v *gocui.View, action string) {
+	toks := strings.SplitN(action, " ", 2)
+	arg := ""
+	if len(toks) > 1 {
+		arg = strings.TrimSpace(toks[1])
+	}
+
+	if ui, ok := uiActions[toks[0]]; ok {
+		ui.run(v, arg)
+		return
+	}
+
+	CommandLine.deliver(event{kind: COMMAND, data: action})
+}
+
+// keymapHelp describes the active bindings, for the help tab
+func keymapHelp() string {
+	describe := func(b *keyBinding) string {
+		if b.help != "" {
+			return b.help
+		}
+		if ui, ok := uiActions[strings.Fields(b.action)[0]]; ok {
+			return fmt.Sprintf("%s (%s)", ui.help, b.action)
+		}
+		return fmt.Sprintf("Run \"%s\"", b.action)
+	}
+
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "\nTAB completes commands, symbols, registers and files on the command line,\n")
+	fmt.Fprintf(out, "or switches tabs if it's empty. C-c quits. Keys are set in keys.cfg or\n")
+	fmt.Fprintf(out, "with \"bind\".\n\n")
+
+	km := currentKeymap()
+	for _, b := range km {
+		if !b.modal {
+			fmt.Fprintf(out, "%-23s %s\n", b.where(), describe(b))
+		}
+	}
+
+	fmt.Fprintf(out, "\nIn hotkey mode:\n")
+	for _, b := range km {
+		if b.modal {
+			fmt.Fprintf(out, "  %-21s %s\n", b.where(), describe(b))
+		}
+	}
+
+	return out.String()
+}
+
+// keysCommand handles "keys", "keys load <file>", "bind" and "unbind"
+func keysCommand(toks []string, line string) bool {
+	switch {
+	case toks[0] == "keys" && len(toks) > 2 && toks[1] == "load":
+		buf, err := ioutil.ReadFile(toks[2])
+		if err == nil {
+			err = loadKeymap(toks[2], string(buf))
+		}
+		if err != nil {
+			logf("%s", err)
+			return false
+		}
+
+	case toks[0] == "keys":
+		lines := []string{}
+		for _, b := range currentKeymap() {
+			mode := ""
+			if b.modal {
+				mode = "modal "
+			}
+			if b.tab != "" {
+				mode += "@" + b.tab + " "
+			}
+			lines = append(lines, fmt.Sprintf("%s%s: %s", mode, b.key, b.action))
+		}
+		sort.Strings(lines)
+		for _, l := range lines {
+			logf("%s", l)
+		}
+
+	case len(toks) < 2:
+		logf("usage: %s [modal] [@tab] <key>: <action>", toks[0])
+		return false
+
+	default:
+		b, err := parseBinding(strings.TrimSpace(strings.TrimPrefix(line, toks[0])))
+		if err != nil {
+			logf("%s", err)
+			return false
+		}
+
+		if toks[0] == "unbind" {
+			if !unbind(b) {
+				logf("%s isn't bound", b.where())
+				return false
+			}
+			return true
+		}
+
+		if b.action == "" {
+			logf("usage: bind [modal] [@tab] <key>: <action>")
+			return false
+		}
+		bind(b)
+	}
+
+	return true
+}
+
+func init() {
+	loadKeymap("defaults", defaultKeymap)
+
+	if buf, err := ioutil.ReadFile("keys.cfg"); err == nil {
+		if err := loadKeymap("keys.cfg", string(buf)); err != nil {
+			logEarly("%s; none of it is bound", err)
+		}
+	}
+}
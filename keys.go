@@ -1,6 +1,10 @@
 package main
 
-import "github.com/jroimartin/gocui"
+import (
+	"strings"
+
+	"github.com/jroimartin/gocui"
+)
 
 type binding struct {
 	v string
@@ -35,6 +39,18 @@ const (
 	STACK_BUMP
 	CLEAR
 	SAVE
+	WATCH_RUN
+	HISTORY
+	DUMP_MOVE
+	DUMP_GOTO
+	DUMP_FOLLOW
+	DUMP_BACK
+	DUMP_GROUP
+	DUMP_AS
+	EVAL
+	RESIZE
+	COMPLETE
+	RELOAD_MACROS
 )
 
 var modal = 0
@@ -51,82 +67,20 @@ func switchMode(v *gocui.View) {
 	}
 }
 
-// genericKey defines most of our key bindings
+// genericKey handles every key in the keymap
 func genericKey(v *gocui.View, kv interface{}) {
-	cmd := func(str string) { CommandLine.deliver(event{kind: COMMAND, data: str}) }
-
-	k, ok := kv.(gocui.Key)
-	if !ok {
-		if modal == 1 {
-			switch kv.(rune) {
-			case 'S':
-				cmd("start")
-			case 's':
-				cmd("step")
-			case 'c':
-				cmd("continue")
-			case 'R':
-				cmd("restart")
-			case 'u':
-				cmd("update")
-			}
-		}
-	}
-
-	if k == gocui.KeyEsc || k == gocui.KeyCtrlX {
-		switchMode(v)
+	// plain characters are typing unless we're in hotkey mode
+	if _, ok := kv.(rune); ok && modal == 0 {
 		return
 	}
 
-	if modal == 1 {
-		switch k {
-		case gocui.KeyArrowDown:
-			Tabbar.down()
-		case gocui.KeyArrowUp:
-			Tabbar.up()
-		}
-	} else {
-		switch k {
-		case gocui.KeyArrowDown:
-			CommandLine.deliver(event{kind: HIST_DOWN})
-		case gocui.KeyArrowUp:
-			CommandLine.deliver(event{kind: HIST_UP})
-		}
+	if CommandLine.searching && CommandLine.searchKey(v, kv) {
+		return
 	}
 
-	switch k {
-	case gocui.KeyCtrlD:
-		Listing.deliver(event{kind: LIST_DOWN})
-	case gocui.KeyCtrlU:
-		Listing.deliver(event{kind: LIST_UP})
-	case gocui.KeyArrowLeft:
-		Listing.deliver(event{kind: LIST_CENTER})
-	case gocui.KeyArrowRight:
-		Tabbar.bottom()
-	case gocui.KeyPgup:
-		Tabbar.up()
-	case gocui.KeyPgdn:
-		Tabbar.down()
-	case gocui.KeyEnter:
-		CommandLine.deliver(event{kind: FLUSH})
-	case gocui.KeyCtrlB:
-		cmd("bump")
-	case gocui.KeyCtrlQ:
-		Tabbar.switchTo("log")
-	case gocui.KeyCtrlW:
-		Tabbar.switchTo("output")
-	case gocui.KeyCtrlE:
-		Tabbar.switchTo("source")
-	case gocui.KeyCtrlR:
-		Tabbar.switchTo("vm")
-	case gocui.KeyCtrlT:
-		Tabbar.switchTo("dump")
-	case gocui.KeyCtrlY:
-		Tabbar.switchTo("stack")
-	case gocui.KeyCtrlH:
-		Tabbar.switchTo("help")
+	if b := lookupKey(keyName(kv)); b != nil {
+		runAction(v, b.action)
 	}
-
 }
 
 func genGenericKey(k interface{}) func(g *gocui.Gui, v *gocui.View) error {
@@ -141,27 +95,19 @@ var bindings = []binding{
 	{"", gocui.KeyTab, gocui.ModNone, keyNextTab},
 }
 
-var genericKeys = []interface{}{
-	gocui.KeyEsc,
-	gocui.KeyEnter,
-	gocui.KeyArrowUp,
-	gocui.KeyArrowDown,
-	gocui.KeyArrowLeft,
-	gocui.KeyArrowRight,
-	gocui.KeyPgup,
-	gocui.KeyPgdn,
-	gocui.KeyCtrlX,
-	gocui.KeyCtrlD,
-	gocui.KeyCtrlQ,
-	gocui.KeyCtrlW,
-	gocui.KeyCtrlE,
-	gocui.KeyCtrlR,
-	gocui.KeyCtrlT,
-	gocui.KeyCtrlY,
-	gocui.KeyCtrlU,
-	gocui.KeyCtrlH,
-	gocui.KeyCtrlB,
-	'S', 's', 'R', 'c', 'u', 'h',
+// bound is the keys we've given gocui a handler for
+var bound = map[string]bool{}
+
+// bindKey has gocui send key to genericKey, if it doesn't already
+func bindKey(key string) {
+	if bound[key] {
+		return
+	}
+
+	if kv, err := keyValue(key); err == nil {
+		g.SetKeybinding("", kv, gocui.ModNone, genGenericKey(kv))
+		bound[key] = true
+	}
 }
 
 func setBindings() {
@@ -171,8 +117,8 @@ func setBindings() {
 		}
 	}
 
-	for _, v := range genericKeys {
-		g.SetKeybinding("", v, gocui.ModNone, genGenericKey(v))
+	for _, b := range currentKeymap() {
+		bindKey(b.key)
 	}
 }
 
@@ -180,7 +126,17 @@ func quit(g *gocui.Gui, v *gocui.View) error {
 	return gocui.ErrQuit
 }
 
+// keyNextTab completes what's on the command line, if there's anything
+// there, and otherwise switches tabs. The line and the cursor belong to
+// gocui, so they're read here and sent along.
 func keyNextTab(g *gocui.Gui, v *gocui.View) error {
+	if cmd, _ := g.View("cmdline"); modal == 0 && strings.TrimSpace(cmd.Buffer()) != "" {
+		ox, _ := cmd.Origin()
+		cx, _ := cmd.Cursor()
+		CommandLine.deliver(event{kind: COMPLETE, data: strings.TrimRight(cmd.Buffer(), "\n"), addr: ox + cx})
+		return nil
+	}
+
 	Tabbar.nextTab()
 	redraw()
 	return nil
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+)
+
+// Layouts. The main area can be split into panes showing a tab each (see
+// tabbar.go); a layout is all of that written down, like
+//
+//   rows 33 *regs:12 stack:8 dump:10
+//
+// which is: panes stacked in rows, the listing taking 33% of the screen,
+// then each pane's tab and weight, with a * on the focused one. Layouts
+// saved with "layout save" go in "layouts.cfg", as "name: layout" lines.
+
+var builtinLayouts = map[string]string{
+	"default": "rows 33 *log:10",
+	"debug":   "rows 33 *regs:12 stack:8 dump:10",
+}
+
+// layouts are the ones we've saved, which win over the built-in ones
+var layouts = map[string]string{}
+
+const layoutFile = "layouts.cfg"
+
+// layout writes down the current layout
+func (self *tabbar) layout() string {
+	toks := []string{"rows", strconv.Itoa(self.listWidth)}
+	if self.cols {
+		toks[0] = "cols"
+	}
+
+	for n, p := range self.panes {
+		s := fmt.Sprintf("%s:%d", p.tab, p.weight)
+		if n == self.focus {
+			s = "*" + s
+		}
+		toks = append(toks, s)
+	}
+
+	return strings.Join(toks, " ")
+}
+
+// setLayout switches to a written-down layout
+func (self *tabbar) setLayout(spec string) error {
+	l, err := self.parseLayout(spec)
+	if err != nil {
+		return err
+	}
+
+	self.cols = l.cols
+	self.listWidth = l.listWidth
+	self.panes = l.panes
+	self.focus = l.focus
+	self.reset()
+	return nil
+}
+
+// layoutSpec is a written-down layout read back in
+type layoutSpec struct {
+	cols      bool
+	listWidth int
+	panes     []*pane
+	focus     int
+}
+
+// parseLayout reads a written-down layout without switching to it, so
+// unlike setLayout it's fine off the gocui goroutine
+func (self *tabbar) parseLayout(spec string) (*layoutSpec, error) {
+	toks := strings.Fields(spec)
+	if len(toks) < 3 || (toks[0] != "rows" && toks[0] != "cols") {
+		return nil, fmt.Errorf("bad layout '%s'", spec)
+	}
+
+	l := &layoutSpec{cols: toks[0] == "cols"}
+
+	width, err := strconv.Atoi(toks[1])
+	if err != nil || width < 10 || width > 90 {
+		return nil, fmt.Errorf("bad listing width '%s'", toks[1])
+	}
+	l.listWidth = width
+
+	for _, tok := range toks[2:] {
+		if strings.HasPrefix(tok, "*") {
+			l.focus = len(l.panes)
+			tok = tok[1:]
+		}
+
+		p := &pane{tab: tok, weight: paneWeight}
+		if i := strings.Index(tok, ":"); i != -1 {
+			p.tab = tok[:i]
+			if p.weight, err = strconv.Atoi(tok[i+1:]); err != nil || p.weight < 1 {
+				return nil, fmt.Errorf("bad weight in '%s'", tok)
+			}
+		}
+
+		if _, ok := self.handlers[p.tab]; !ok {
+			return nil, fmt.Errorf("no tab named '%s'", p.tab)
+		}
+
+		l.panes = append(l.panes, p)
+	}
+
+	return l, nil
+}
+
+// layoutName is true if name can be saved: it has to fit layouts.cfg's
+// "name: layout" lines, and "layout <name>" has to be able to reach it
+func layoutName(name string) bool {
+	switch name {
+	case "rows", "cols", "listing", "save", "del", "delete", "list":
+		return false
+	}
+
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func loadLayouts() {
+	buf, err := ioutil.ReadFile(layoutFile)
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(string(buf), "\n") {
+		tups := strings.SplitN(line, ":", 2)
+		if len(tups) == 2 && !strings.HasPrefix(line, "#") && layoutName(strings.TrimSpace(tups[0])) {
+			layouts[strings.TrimSpace(tups[0])] = strings.TrimSpace(tups[1])
+		}
+	}
+}
+
+func saveLayouts() {
+	names := []string{}
+	for name := range layouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	f, err := os.Create(layoutFile)
+	if err != nil {
+		logf("can't write %s: %s", layoutFile, err)
+		return
+	}
+	defer f.Close()
+
+	for _, name := range names {
+		fmt.Fprintf(f, "%s: %s\n", name, layouts[name])
+	}
+}
+
+// onGui runs f on the gocui goroutine, which is the only place the panes
+// should change
+func onGui(f func()) {
+	g.Execute(func(g *gocui.Gui) error {
+		f()
+		return nil
+	})
+}
+
+// paneCommand handles split, unsplit, only and pane
+func paneCommand(toks []string) bool {
+	arg := ""
+	if len(toks) > 1 {
+		arg = toks[1]
+	}
+
+	switch toks[0] {
+	case "split":
+		// the panes can only be looked at on the gocui goroutine, but the
+		// tabs don't change, so a bad name can fail here
+		if _, ok := Tabbar.handlers[arg]; arg != "" && !ok {
+			logf("no tab named '%s'", arg)
+			return false
+		}
+		onGui(func() { Tabbar.split(arg) })
+	case "unsplit":
+		onGui(func() { Tabbar.close(Tabbar.focus) })
+	case "only":
+		onGui(func() { Tabbar.only() })
+	case "pane":
+		steps := 1
+		if len(toks) > 2 {
+			var err error
+			if steps, err = strconv.Atoi(toks[2]); err != nil || steps < 1 {
+				logf("pane grow|shrink [steps]")
+				return false
+			}
+		}
+
+		switch arg {
+		case "next", "":
+			onGui(func() {
+				Tabbar.focus = (Tabbar.focus + 1) % len(Tabbar.panes)
+				redraw()
+			})
+		case "grow":
+			onGui(func() { Tabbar.grow(steps) })
+		case "shrink":
+			onGui(func() { Tabbar.grow(-steps) })
+		default:
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 {
+				logf("pane [next|grow|shrink|<n>]")
+				return false
+			}
+			onGui(func() {
+				if n < 1 || n > len(Tabbar.panes) {
+					logf("no pane %d", n)
+					return
+				}
+				Tabbar.focus = n - 1
+				redraw()
+			})
+		}
+	}
+
+	return true
+}
+
+func layoutCommand(toks []string) bool {
+	if len(toks) < 2 {
+		logf("layout: %s", Tabbar.layout())
+
+		names := []string{}
+		for name := range builtinLayouts {
+			if _, ok := layouts[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		for name := range layouts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		logf("saved: %s", strings.Join(names, " "))
+		return true
+	}
+
+	switch toks[1] {
+	case "rows", "cols":
+		onGui(func() {
+			Tabbar.cols = toks[1] == "cols"
+			redraw()
+		})
+
+	case "listing":
+		width := 0
+		if len(toks) > 2 {
+			width, _ = strconv.Atoi(toks[2])
+		}
+		if width < 10 || width > 90 {
+			logf("layout listing <10-90>")
+			return false
+		}
+		onGui(func() {
+			Tabbar.listWidth = width
+			redraw()
+		})
+
+	case "save":
+		if len(toks) != 3 || !layoutName(toks[2]) {
+			logf("layout save <name>; names are letters, digits, - and _, and not a layout command")
+			return false
+		}
+		layouts[toks[2]] = Tabbar.layout()
+		saveLayouts()
+		logf("saved layout %s: %s", toks[2], layouts[toks[2]])
+
+	case "del":
+		if len(toks) < 3 {
+			logf("layout del <name>")
+			return false
+		}
+		if _, ok := layouts[toks[2]]; !ok {
+			logf("no saved layout %s", toks[2])
+			return false
+		}
+		delete(layouts, toks[2])
+		saveLayouts()
+
+	default:
+		spec, ok := layouts[toks[1]]
+		if !ok {
+			spec, ok = builtinLayouts[toks[1]]
+		}
+		if !ok {
+			logf("no layout named %s", toks[1])
+			return false
+		}
+
+		if _, err := Tabbar.parseLayout(spec); err != nil {
+			logf("%s", err)
+			return false
+		}
+
+		onGui(func() {
+			if err := Tabbar.setLayout(spec); err != nil {
+				logf("%s", err)
+			}
+		})
+	}
+
+	return true
+}
+
+func init() {
+	loadLayouts()
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jroimartin/gocui"
@@ -20,6 +22,19 @@ type listing struct {
 	notFollowing bool
 	lastPC       int
 	bps          []uint16
+	scale        int
+	syms         []symbol // in address order, like the listing
+
+	// loaded is closed once we've got a program, so things that need
+	// symbols (like .debuggerrc) can wait for it
+	loaded     chan bool
+	loadedOnce sync.Once
+}
+
+// symbol is a function (or other label) in the program listing
+type symbol struct {
+	name string
+	addr int
 }
 
 //  {
@@ -63,15 +78,27 @@ func (self *listing) fetch() {
 	self.notFollowing = true
 	self.lindex = map[int]int{}
 	self.symdex = map[string]int{}
+	self.syms = nil
 
 	for i, v := range self.program {
 		if sym := v.Sym(); sym != "" {
 			self.symdex[sym] = v.Offset
+			self.syms = append(self.syms, symbol{name: sym, addr: v.Offset})
 		}
 
 		self.lindex[v.Offset] = i
 	}
 
+	// objdump listings count bytes; if we see consecutive instructions one
+	// apart, the emulator is counting words instead
+	self.scale = 2
+	for i := 1; i < len(self.program); i++ {
+		if self.program[i].Offset-self.program[i-1].Offset == 1 {
+			self.scale = 1
+			break
+		}
+	}
+
 	withViewNamed("listing", func(v *gocui.View) {
 		v.Clear()
 		_, rows := v.Size()
@@ -81,6 +108,10 @@ func (self *listing) fetch() {
 			}
 		}
 	})
+
+	if len(self.program) > 0 {
+		self.loadedOnce.Do(func() { close(self.loaded) })
+	}
 }
 
 func (self *listing) redraw() {
@@ -101,12 +132,16 @@ func (self *listing) redraw() {
 
 			sym := insn.Sym()
 
-			if i+self.curLine == self.hiLine {
-				fmt.Fprintf(v, ">> %s %s\n", insn.String(), sym)
+			// the PC and breakpoint lines are colored whole, everything
+			// else a piece at a time
+			if i+self.curLine == self.hiLine && History.active() {
+				fmt.Fprintf(v, "%s\n", color("pc", fmt.Sprintf("<< %s %s", insn.String(), sym)))
+			} else if i+self.curLine == self.hiLine {
+				fmt.Fprintf(v, "%s\n", color("pc", fmt.Sprintf(">> %s %s", insn.String(), sym)))
 			} else if hit(uint16(insn.Offset), self.bps) {
-				fmt.Fprintf(v, "!! %s %s\n", insn.String(), sym)
+				fmt.Fprintf(v, "%s\n", color("breakpoint", fmt.Sprintf("!! %s %s", insn.String(), sym)))
 			} else {
-				fmt.Fprintf(v, "   %s %s\n", insn.String(), sym)
+				fmt.Fprintf(v, "   %s %s\n", insn.Colored(), color("symbol", sym))
 			}
 		}
 	})
@@ -126,6 +161,71 @@ func (self *listing) lineAt(addr int) {
 	}
 }
 
+// insnAt returns the instruction at addr, or nil if there isn't one
+func (self *listing) insnAt(addr int) *Instruction {
+	if line, ok := self.lindex[addr]; ok {
+		return &self.program[line]
+	}
+	return nil
+}
+
+// next returns the address of the instruction after the one at addr, or -1
+func (self *listing) next(addr int) int {
+	if line, ok := self.lindex[addr]; ok && line+1 < len(self.program) {
+		return self.program[line+1].Offset
+	}
+	return -1
+}
+
+// symbolAt returns the nearest symbol at or before addr
+func (self *listing) symbolAt(addr int) (symbol, bool) {
+	i := sort.Search(len(self.syms), func(i int) bool {
+		return self.syms[i].addr > addr
+	})
+
+	if i == 0 {
+		return symbol{}, false
+	}
+
+	return self.syms[i-1], true
+}
+
+// symbolize renders addr as "function+off", or "??" if it's before every
+// symbol we know about
+func (self *listing) symbolize(addr int) string {
+	sym, ok := self.symbolAt(addr)
+	if !ok {
+		return "??"
+	}
+
+	if addr == sym.addr {
+		return sym.name
+	}
+
+	return fmt.Sprintf("%s+0x%x", sym.name, addr-sym.addr)
+}
+
+// codeAddr converts a word address (what CALL pushes on the stack) into the
+// units the listing and the PC use
+func (self *listing) codeAddr(word int) int {
+	if self.scale == 0 {
+		return word * 2
+	}
+	return word * self.scale
+}
+
+// target returns where a jump, call or branch goes, if it goes somewhere
+// fixed (IJMP and friends go wherever Z says)
+func (self *listing) target(insn *Instruction) (int, bool) {
+	switch op := strings.ToUpper(insn.Opcode); {
+	case op == "JMP" || op == "CALL":
+		return self.codeAddr(insn.K), true
+	case op == "RJMP" || op == "RCALL" || (strings.HasPrefix(op, "BR") && op != "BREAK"):
+		return insn.Offset + self.codeAddr(insn.K+1), true
+	}
+	return 0, false
+}
+
 type Breakpoints struct {
 	Breakpoints []int `json:"breakpoints"`
 }
@@ -170,16 +270,25 @@ func (self *listing) loop() {
 			self.lineAt(event.addr)
 		case LIST_CENTER:
 			self.lineAt(self.lastPC)
+		// scroll by event.addr lines, or 10
 		case LIST_UP:
-			if (self.curLine - 10) > 0 {
-				self.curLine -= 10
+			n := event.addr
+			if n == 0 {
+				n = 10
+			}
+			if (self.curLine - n) > 0 {
+				self.curLine -= n
 			} else {
 				self.curLine = 0
 			}
 			self.redraw()
 		case LIST_DOWN:
-			if (self.curLine + 10) < len(self.program) {
-				self.curLine += 10
+			n := event.addr
+			if n == 0 {
+				n = 10
+			}
+			if (self.curLine + n) < len(self.program) {
+				self.curLine += n
 				self.redraw()
 			}
 		case REFRESH_BPS:
@@ -194,6 +303,7 @@ func (self *listing) deliver(e event) {
 
 func (self *listing) makechan() {
 	self.c = make(chan event)
+	self.loaded = make(chan bool)
 }
 
 type AvrIns struct {
@@ -517,7 +627,27 @@ func (self *Instruction) Sym() string {
 	return toks[0]
 }
 
+// isCall is true for the instructions that push a return address
+func (self *Instruction) isCall() bool {
+	switch strings.ToUpper(self.Opcode) {
+	case "CALL", "RCALL", "ICALL", "EICALL":
+		return true
+	}
+	return false
+}
+
 func (self *Instruction) String() string {
+	return self.format(func(role, s string) string { return s })
+}
+
+// Colored is String with the mnemonic and operands colored by the theme
+func (self *Instruction) Colored() string {
+	return self.format(color)
+}
+
+// format renders the instruction, passing each piece through paint with
+// the theme role it gets
+func (self *Instruction) format(paint func(role, s string) string) string {
 	r, ok := avrTable[strings.ToUpper(self.Opcode)]
 	if !ok {
 		return fmt.Sprintf("%0.4x: [%s]", self.Offset, strings.ToUpper(self.Opcode))
@@ -526,24 +656,24 @@ func (self *Instruction) String() string {
 	out := &bytes.Buffer{}
 	fmt.Fprintf(out, "%0.4x: ", self.Offset)
 
-	fmt.Fprintf(out, "%s ", r.M)
+	fmt.Fprintf(out, "%s ", paint(insnClass(strings.ToUpper(self.Opcode)), r.M))
 	if r.K {
-		fmt.Fprintf(out, "%d ", self.K)
+		fmt.Fprintf(out, "%s ", paint("immediate", fmt.Sprintf("%d", self.K)))
 	}
 	if r.Dst {
-		fmt.Fprintf(out, "r%d ", self.Dst)
+		fmt.Fprintf(out, "%s ", paint("register", fmt.Sprintf("r%d", self.Dst)))
 	}
 	if r.Src {
-		fmt.Fprintf(out, "r%d ", self.Src)
+		fmt.Fprintf(out, "%s ", paint("register", fmt.Sprintf("r%d", self.Src)))
 	}
 	if r.S {
-		fmt.Fprintf(out, "%d ", self.S)
+		fmt.Fprintf(out, "%s ", paint("immediate", fmt.Sprintf("%d", self.S)))
 	}
 	if r.B {
-		fmt.Fprintf(out, "%d ", self.B)
+		fmt.Fprintf(out, "%s ", paint("immediate", fmt.Sprintf("%d", self.B)))
 	}
 	if r.Q {
-		fmt.Fprintf(out, "%d ", self.Q)
+		fmt.Fprintf(out, "%s ", paint("immediate", fmt.Sprintf("%d", self.Q)))
 	}
 	return out.String()
 }
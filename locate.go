@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Location specifiers. Every command that takes an address goes through
+// locate(), which understands:
+//
+//   1234, 0x1234    hex (addresses are hex everywhere else in the UI)
+//   0d4660          decimal
+//   main, &main     a symbol; use &name if the name is also a hex number
+//   main+0x10       a symbol (or anything else here) plus or minus hex offsets
+//   $pc, $sp        the current PC or stack pointer
+//   *X, *Y, *Z      the address in a pointer register
+//   ret             the current function's return address
+//
+// Code and data addresses aren't in the same units when they come out of a
+// register or off the stack, so callers say which they want.
+
+type locKind int
+
+const (
+	codeLoc locKind = iota
+	dataLoc
+)
+
+// locNumber parses a hex (default or 0x) or decimal (0d) number
+func locNumber(s string) (int, bool) {
+	base := 16
+	digits := s
+
+	switch {
+	case strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0X"):
+		digits = s[2:]
+	case strings.HasPrefix(s, "0d"), strings.HasPrefix(s, "0D"):
+		base = 10
+		digits = s[2:]
+	}
+
+	n, err := strconv.ParseUint(digits, base, 16)
+	if err != nil {
+		return 0, false
+	}
+
+	return int(n), true
+}
+
+// locCPU gets the CPU state for locations that depend on it; we only fetch
+// it if we need it
+func locCPU(cpu **ApuState) (*ApuState, error) {
+	if *cpu == nil {
+		ctx, err := liveContext()
+		if err != nil {
+			return nil, err
+		}
+		*cpu = ctx.cpu
+	}
+
+	return *cpu, nil
+}
+
+// locBase resolves the first term of a location
+func locBase(term string, kind locKind, cpu **ApuState) (int, error) {
+	switch strings.ToLower(term) {
+	case "$pc", "$sp", "*x", "*y", "*z", "ret":
+		c, err := locCPU(cpu)
+		if err != nil {
+			return 0, err
+		}
+
+		ptr := 0
+
+		switch strings.ToLower(term) {
+		case "$pc":
+			return c.Pc, nil
+		case "$sp":
+			return int(c.sp()), nil
+		case "ret":
+			ret, _, ok := findReturn(c)
+			if !ok {
+				return 0, fmt.Errorf("can't find a return address on the stack")
+			}
+			return ret, nil
+		case "*x":
+			ptr = int(c.pair(26))
+		case "*y":
+			ptr = int(c.pair(28))
+		case "*z":
+			ptr = int(c.pair(30))
+		}
+
+		// pointers to code (ICALL/IJMP through Z) hold word addresses
+		if kind == codeLoc {
+			return Listing.codeAddr(ptr), nil
+		}
+		return ptr, nil
+	}
+
+	if strings.HasPrefix(term, "&") {
+		addr, ok := Listing.symdex[term[1:]]
+		if !ok {
+			return 0, fmt.Errorf("no symbol named '%s'", term[1:])
+		}
+		return addr, nil
+	}
+
+	n, isNum := locNumber(term)
+	addr, isSym := Listing.symdex[term]
+
+	switch {
+	case isNum && isSym:
+		return 0, fmt.Errorf("'%s' is both a symbol (%0.4x) and a hex number; say &%s or 0x%s", term, addr, term, term)
+	case isSym:
+		return addr, nil
+	case isNum:
+		return n, nil
+	}
+
+	return 0, fmt.Errorf("no symbol or address '%s'", term)
+}
+
+// locate resolves a location specifier to an address
+func locate(spec string, kind locKind) (int, error) {
+	spec = strings.Replace(spec, " ", "", -1)
+	if spec == "" {
+		return 0, fmt.Errorf("missing location")
+	}
+
+	var cpu *ApuState
+
+	// split on + and -; everything after the first term is an offset
+	start, sign, addr := 0, 1, 0
+	for i := 1; i <= len(spec); i++ {
+		if i < len(spec) && spec[i] != '+' && spec[i] != '-' {
+			continue
+		}
+
+		term := spec[start:i]
+		if start == 0 {
+			base, err := locBase(term, kind, &cpu)
+			if err != nil {
+				return 0, err
+			}
+			addr = base
+		} else {
+			off, ok := locNumber(term)
+			if !ok {
+				return 0, fmt.Errorf("bad offset '%s' in %s", term, spec)
+			}
+			addr += sign * off
+		}
+
+		if i < len(spec) {
+			sign = 1
+			if spec[i] == '-' {
+				sign = -1
+			}
+			start = i + 1
+		}
+	}
+
+	if addr < 0 || addr > 0xffff {
+		return 0, fmt.Errorf("%s is out of range (%x)", spec, addr)
+	}
+
+	return addr, nil
+}
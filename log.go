@@ -51,15 +51,17 @@ func (self *logbox) save(file string) {
 
 func (self *logbox) logLine(line string) {
 	self.log = append(self.log, line)
-	v, _ := g.View("tabview")
-	v.Autoscroll = true
+	if v := Tabbar.view("log"); v != nil {
+		v.Autoscroll = true
+	}
 }
 
 func (self *logbox) clear() {
 	self.log = []string{}
 	self.written = 0
-	v, _ := g.View("tabview")
-	v.Clear()
+	if v := Tabbar.view("log"); v != nil {
+		v.Clear()
+	}
 	redraw()
 }
 
@@ -81,6 +83,15 @@ func logf(format string, args ...interface{}) {
 	Log.deliver(event{kind: LINE, data: fmt.Sprintf(format, args...)})
 }
 
+// earlyLog holds what was logged before the log was running, like problems
+// with the config files init reads; boot logs it once the log is up
+var earlyLog []string
+
+// logEarly is logf for before boot
+func logEarly(format string, args ...interface{}) {
+	earlyLog = append(earlyLog, fmt.Sprintf(format, args...))
+}
+
 func logError(source string, err error) {
 	if err != nil {
 		logf("%s error: %s", source, err)
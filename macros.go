@@ -0,0 +1,540 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Macros. macros.cmd has one-liners:
+//
+//   name: command; command; ...
+//
+// and longer ones:
+//
+//   define name
+//     command
+//     ...
+//   end
+//
+// Either way, "name arg arg" runs the commands with $1, $2... replaced by
+// the arguments, $@ by all of them and $# by how many there are. Inside,
+// "local x = <expr>" makes $x, and there's
+//
+//   if <expr> ... [else ...] end
+//   while <expr> ... end
+//   repeat <expr> ... end
+//
+// where expressions are the same as for "print", against the device as it
+// is when they're evaluated. The first command that fails (anything
+// parseTerm says didn't work, down to a usage message) stops the macro, and
+// the macros that called it. Macros can also be defined at the command line
+// with "define", and macros.cmd is re-read when it changes.
+
+const (
+	macroFile     = "macros.cmd"
+	macroMaxDepth = 16    // macros calling macros
+	macroMaxLoops = 10000 // times around a while loop
+)
+
+// macroDef is a macro being defined a line at a time
+type macroDef struct {
+	name  string
+	body  []string
+	depth int // of if/while/repeat blocks
+}
+
+// macroEnv is a macro's arguments and locals
+type macroEnv struct {
+	args   []string
+	locals map[string]string
+}
+
+var rxMacroVar = regexp.MustCompile(`\$(@|#|[0-9]+|[A-Za-z_][A-Za-z0-9_]*)`)
+
+// substitute fills in $1, $@, $# and locals; anything else that starts with
+// a $ (like $pc) is left for the expression evaluator
+func (self *macroEnv) substitute(line string) (out string, err error) {
+	out = rxMacroVar.ReplaceAllStringFunc(line, func(v string) string {
+		name := v[1:]
+		switch {
+		case name == "@":
+			return strings.Join(self.args, " ")
+		case name == "#":
+			return strconv.Itoa(len(self.args))
+		case name[0] >= '0' && name[0] <= '9':
+			n, _ := strconv.Atoi(name)
+			if n < 1 || n > len(self.args) {
+				err = fmt.Errorf("no argument %s", v)
+				return v
+			}
+			return self.args[n-1]
+		}
+
+		if local, ok := self.locals[name]; ok {
+			return local
+		}
+		return v
+	})
+	return
+}
+
+// splitStatements breaks a body up at semicolons
+func splitStatements(body string) []string {
+	stmts := []string{}
+	for _, s := range strings.Split(body, ";") {
+		if s = strings.TrimSpace(s); s != "" {
+			stmts = append(stmts, s)
+		}
+	}
+	return stmts
+}
+
+func firstWord(s string) (word, rest string) {
+	toks := strings.SplitN(strings.TrimSpace(s), " ", 2)
+	if len(toks) > 1 {
+		return toks[0], strings.TrimSpace(toks[1])
+	}
+	return toks[0], ""
+}
+
+// blockDelta is +1 for statements that open a block and -1 for "end"
+func blockDelta(stmt string) int {
+	switch word, _ := firstWord(stmt); word {
+	case "if", "while", "repeat":
+		return 1
+	case "end":
+		return -1
+	}
+	return 0
+}
+
+// matchBlock finds the "else" (if any) and "end" for the block stmts[at]
+// opens
+func matchBlock(stmts []string, at int) (elseAt, end int, err error) {
+	depth := 0
+	elseAt = -1
+
+	for j := at + 1; j < len(stmts); j++ {
+		word, _ := firstWord(stmts[j])
+		switch {
+		case word == "else" && depth == 0 && elseAt == -1:
+			elseAt = j
+		case word == "end" && depth == 0:
+			return elseAt, j, nil
+		}
+		depth += blockDelta(stmts[j])
+	}
+
+	return 0, 0, fmt.Errorf("'%s' has no end", stmts[at])
+}
+
+// condition evaluates an if/while expression
+func (self *commandLine) condition(src string, env *macroEnv) (bool, bool) {
+	n, ok := self.number(src, env)
+	return n != 0, ok
+}
+
+func (self *commandLine) number(src string, env *macroEnv) (int64, bool) {
+	src, err := env.substitute(src)
+	if err != nil {
+		logf("%s", err)
+		return 0, false
+	}
+
+	ctx, err := liveContext()
+	if err != nil {
+		logf("%s", err)
+		return 0, false
+	}
+
+	v, err := evaluate(src, ctx)
+	if err != nil {
+		logf("%s: %s", src, err)
+		return 0, false
+	}
+
+	return v.n, true
+}
+
+// exec runs statements, returning false if something went wrong, which
+// stops the whole macro
+func (self *commandLine) exec(stmts []string, env *macroEnv) bool {
+	for i := 0; i < len(stmts); i++ {
+		word, rest := firstWord(stmts[i])
+
+		switch word {
+		case "if", "while", "repeat":
+			elseAt, end, err := matchBlock(stmts, i)
+			if err != nil {
+				logf("%s", err)
+				return false
+			}
+
+			body := stmts[i+1 : end]
+			if word == "if" && elseAt != -1 {
+				body = stmts[i+1 : elseAt]
+			}
+
+			switch word {
+			case "if":
+				yes, ok := self.condition(rest, env)
+				if !ok {
+					return false
+				}
+				if yes && !self.exec(body, env) {
+					return false
+				}
+				if !yes && elseAt != -1 && !self.exec(stmts[elseAt+1:end], env) {
+					return false
+				}
+
+			case "while":
+				for n := 0; ; n++ {
+					if n == macroMaxLoops {
+						logf("while %s: gave up after %d times around", rest, n)
+						return false
+					}
+
+					yes, ok := self.condition(rest, env)
+					if !ok {
+						return false
+					}
+					if !yes {
+						break
+					}
+					if !self.exec(body, env) {
+						return false
+					}
+				}
+
+			case "repeat":
+				times, ok := self.number(rest, env)
+				if !ok {
+					return false
+				}
+				for n := int64(0); n < times; n++ {
+					if !self.exec(body, env) {
+						return false
+					}
+				}
+			}
+
+			i = end
+
+		case "local":
+			tups := strings.SplitN(rest, "=", 2)
+			name := strings.TrimSpace(tups[0])
+			if len(tups) != 2 || name == "" {
+				logf("local <name> = <expr>")
+				return false
+			}
+
+			n, ok := self.number(tups[1], env)
+			if !ok {
+				return false
+			}
+			if env.locals == nil {
+				env.locals = map[string]string{}
+			}
+			env.locals[name] = fmt.Sprintf("0x%x", n)
+
+		case "else", "end":
+			logf("'%s' without if/while/repeat", word)
+			return false
+
+		default:
+			line, err := env.substitute(stmts[i])
+			if err != nil {
+				logf("%s", err)
+				return false
+			}
+			if !self.parse(line) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// isMacro is true if name is a macro we'd run; one with a command's name
+// would hide the command (and usually call itself forever), so it doesn't
+// count
+func (self *commandLine) isMacro(name string) bool {
+	_, ok := self.macros[name]
+	return ok && !isCommand(name)
+}
+
+// call runs macro name with args
+func (self *commandLine) call(name string, args []string) bool {
+	if self.callDepth >= macroMaxDepth {
+		logf("%s: macros nested too deep", name)
+		return false
+	}
+
+	self.callDepth++
+	defer func() { self.callDepth-- }()
+
+	return self.exec(splitStatements(self.macros[name]), &macroEnv{args: args})
+}
+
+// capture adds a line to the macro we're defining, finishing it at the
+// "end" that matches "define"
+func (self *commandLine) capture(line string) {
+	def := self.defining
+
+	for _, stmt := range splitStatements(line) {
+		def.depth += blockDelta(stmt)
+		if def.depth < 0 {
+			self.macros[def.name] = strings.Join(def.body, "; ")
+			self.defining = nil
+			logf("defined %s", def.name)
+			return
+		}
+		def.body = append(def.body, stmt)
+	}
+}
+
+// parseMacros reads macros.cmd-style text
+func parseMacros(text string) (map[string]string, error) {
+	macros := map[string]string{}
+
+	var def *macroDef
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if def != nil {
+			for _, stmt := range splitStatements(line) {
+				def.depth += blockDelta(stmt)
+				if def.depth < 0 {
+					macros[def.name] = strings.Join(def.body, "; ")
+					def = nil
+					break
+				}
+				def.body = append(def.body, stmt)
+			}
+			continue
+		}
+
+		if word, rest := firstWord(line); word == "define" && !strings.Contains(rest, ":") {
+			def = &macroDef{name: rest}
+			continue
+		} else if word == "define" {
+			line = rest
+		}
+
+		tups := strings.SplitN(line, ":", 2)
+		if len(tups) != 2 {
+			return nil, fmt.Errorf("line %d: expected \"name: commands\" or \"define name\"", i+1)
+		}
+		macros[strings.TrimSpace(tups[0])] = strings.TrimSpace(tups[1])
+	}
+
+	if def != nil {
+		return nil, fmt.Errorf("define %s has no end", def.name)
+	}
+
+	return macros, nil
+}
+
+// loadMacros (re)reads the macro file; macros that came from it before are
+// replaced, and ones defined at the command line are kept
+func (self *commandLine) loadMacros(file string) error {
+	if self.macros == nil {
+		self.macros = map[string]string{}
+	}
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	macros, err := parseMacros(string(buf))
+	if err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+
+	for name := range self.fromFile {
+		delete(self.macros, name)
+	}
+
+	self.fromFile = map[string]bool{}
+	for name, body := range macros {
+		if isCommand(name) {
+			logf("%s: macro %s has a command's name; ignoring it", file, name)
+			continue
+		}
+		self.macros[name] = body
+		self.fromFile[name] = true
+	}
+
+	self.macroMod = fi.ModTime()
+	return nil
+}
+
+func (self *commandLine) saveMacros(file string) error {
+	names := []string{}
+	for name := range self.macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		fmt.Fprintf(f, "%s: %s\n", name, self.macros[name])
+	}
+	f.Close()
+
+	// everything's in the file now, and there's no need to reload it
+	self.fromFile = map[string]bool{}
+	for _, name := range names {
+		self.fromFile[name] = true
+	}
+	if fi, err := os.Stat(file); err == nil {
+		self.macroMod = fi.ModTime()
+	}
+
+	return nil
+}
+
+// watchMacros asks the command line to reload the macro file when it
+// changes
+func (self *commandLine) watchMacros(file string) {
+	var last time.Time
+	for {
+		time.Sleep(2 * time.Second)
+
+		if fi, err := os.Stat(file); err == nil && fi.ModTime() != last {
+			last = fi.ModTime()
+			self.deliver(event{kind: RELOAD_MACROS, data: file, addr: int(last.Unix())})
+		}
+	}
+}
+
+// macroCommand handles define, macros and macro, returning false if it
+// couldn't do what it was asked
+func (self *commandLine) macroCommand(toks []string, line string) bool {
+	_, rest := firstWord(line)
+
+	switch toks[0] {
+	case "define":
+		if rest == "" {
+			logf("define <name>, then commands, then end; or define <name>: commands")
+			return false
+		}
+
+		name, body := rest, ""
+		i := strings.Index(rest, ":")
+		if i != -1 {
+			name, body = strings.TrimSpace(rest[:i]), rest[i+1:]
+		}
+
+		if isCommand(name) {
+			logf("%s is a command; macros need a name of their own", name)
+			return false
+		}
+
+		if i != -1 {
+			self.macros[name] = strings.Join(splitStatements(body), "; ")
+			logf("defined %s", name)
+			return true
+		}
+
+		self.defining = &macroDef{name: name}
+		logf("defining %s; \"end\" to finish", name)
+
+	case "macros":
+		names := []string{}
+		for name := range self.macros {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			logf("%s: %s", name, self.macros[name])
+		}
+		if len(names) == 0 {
+			logf("no macros")
+		}
+
+	case "macro":
+		sub, name := firstWord(rest)
+		switch sub {
+		case "show":
+			body, ok := self.macros[name]
+			if !ok {
+				logf("no macro %s", name)
+				return false
+			}
+
+			logf("define %s", name)
+			depth := 1
+			for _, stmt := range splitStatements(body) {
+				word, _ := firstWord(stmt)
+				if word == "end" || word == "else" {
+					depth--
+				}
+				logf("%s%s", strings.Repeat("  ", depth), stmt)
+				if word == "else" || blockDelta(stmt) > 0 {
+					depth++
+				}
+			}
+			logf("end")
+
+		case "edit":
+			body, ok := self.macros[name]
+			if !ok {
+				logf("no macro %s", name)
+				return false
+			}
+			self.setLine(fmt.Sprintf("define %s: %s", name, body))
+
+		case "del":
+			if _, ok := self.macros[name]; !ok {
+				logf("no macro %s", name)
+				return false
+			}
+			delete(self.macros, name)
+
+		case "save":
+			if name == "" {
+				name = macroFile
+			}
+			if err := self.saveMacros(name); err != nil {
+				logf("%s", err)
+				return false
+			}
+			logf("saved macros to %s", name)
+
+		case "reload":
+			if err := self.loadMacros(macroFile); err != nil {
+				logf("%s", err)
+				return false
+			}
+
+		default:
+			logf("macro show|edit|del|save|reload")
+			return false
+		}
+	}
+
+	return true
+}
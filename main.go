@@ -98,6 +98,21 @@ var (
 
 	// Help is the "help" tab
 	Help help
+
+	// Watcher single-steps the device to implement watchpoints
+	Watcher watcher
+
+	// Trace is the "trace" tab, and records execution history
+	Trace tracer
+
+	// History is the cursor for looking at recorded states
+	History history
+
+	// Watches is the "watch" tab of expressions shown at every stop
+	Watches watches
+
+	// Regs is the "regs" tab
+	Regs regs
 )
 
 // components lists all the components the system will initialize
@@ -112,6 +127,10 @@ var components = []receiver{
 	&Dump,
 	&Stack,
 	&Help,
+	&Watcher,
+	&Trace,
+	&Watches,
+	&Regs,
 }
 
 // g is the global handle to the gocui.Gui object; g.Execute() is thread-safe
@@ -138,6 +157,9 @@ var Tabbar = tabbar{
 		"vm",
 		"dump",
 		"stack",
+		"regs",
+		"trace",
+		"watch",
 		"help",
 	},
 
@@ -150,11 +172,18 @@ var Tabbar = tabbar{
 		"vm":     renderVm,
 		"dump":   renderDump,
 		"stack":  renderStack,
+		"regs":   renderRegs,
+		"trace":  renderTrace,
+		"watch":  renderWatches,
 		"help":   renderHelp,
 	},
 
-	// selected is our current tab
-	selected: 0,
+	// panes are what the main area is split into; it starts as one pane
+	// showing the log
+	panes: []*pane{{tab: "log", weight: paneWeight}},
+
+	// listWidth is how much of the screen (in percent) the listing gets
+	listWidth: 33,
 }
 
 // redraw tells the gocui loop to redraw the interface instead of waiting for
@@ -168,19 +197,22 @@ func redraw() {
 func Layout(g *gocui.Gui) error {
 	mx, my := g.Size()
 
-	if top, err := g.SetView("status", 0, 0, mx-1, 2); err != nil {
+	if top, err := g.SetView("status", 0, 0, mx-1, 3); err != nil {
 		fmt.Fprintf(top, "hello\n")
 	}
 
-	if _, err := g.SetView("listing", 0, 2, mx/3, my-2); err != nil {
+	lx := mx * Tabbar.listWidth / 100
+
+	if _, err := g.SetView("listing", 0, 3, lx, my-2); err != nil {
 
 	}
 
-	g.SetView("tabbar", mx/3, 2, mx-1, 4)
-	Tabbar.renderView(mx/3, 4, mx-1, my-2)
+	g.SetView("tabbar", lx, 3, mx-1, 5)
+	Tabbar.renderView(lx, 5, mx-1, my-2)
 
 	if bottom, err := g.SetView("cmdline", 0, my-2, mx-1, my); err != nil {
 		bottom.Editable = true
+		bottom.Editor = gocui.EditorFunc(cmdlineEditor)
 		if err := g.SetCurrentView("cmdline"); err != nil {
 			return err
 		}
@@ -214,13 +246,19 @@ func boot() {
 	for _, r := range components {
 		go r.loop()
 	}
+
+	for _, line := range earlyLog {
+		logf("%s", line)
+	}
 }
 
 func main() {
 	var user, pass string
+	var nomouse bool
 
 	flag.StringVar(&user, "u", "", "Username on stockfighter.io (or env SFJB_USER")
 	flag.StringVar(&pass, "p", "", "Password on stockfighter.io (or env SFJB_PASS")
+	flag.BoolVar(&nomouse, "nomouse", false, "Leave the mouse to the terminal, for selecting text")
 	flag.Parse()
 
 	if user == "" {
@@ -255,6 +293,12 @@ func main() {
 
 	setBindings()
 
+	if !nomouse {
+		setMouse()
+	}
+
+	go runRCFiles()
+
 	// gocui takes over our keyboard, so listen for SIGHUP to panic
 	// the process if it hangs
 
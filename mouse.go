@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+)
+
+// Mouse. Clicking a line in the listing toggles a breakpoint there, unless
+// it's a jump, call or branch and you clicked its operands, in which case
+// the listing goes to where it jumps to. Clicking a tab name switches to
+// it, clicking a pane focuses it, and the wheel scrolls whatever it's over.
+// Start with -nomouse to leave the mouse to the terminal (to select text).
+
+// wheelLines is how far a notch of the scroll wheel moves the listing
+const wheelLines = 3
+
+func setMouse() {
+	g.Mouse = true
+
+	g.SetKeybinding("", gocui.MouseLeft, gocui.ModNone, mouseClick)
+	g.SetKeybinding("", gocui.MouseWheelUp, gocui.ModNone, mouseWheel(-1))
+	g.SetKeybinding("", gocui.MouseWheelDown, gocui.ModNone, mouseWheel(1))
+}
+
+// paneNumber returns which pane a view is, or -1
+func paneNumber(name string) int {
+	if name == "tabview" {
+		return 0
+	}
+
+	if strings.HasPrefix(name, "tabview") {
+		if n, err := strconv.Atoi(strings.TrimPrefix(name, "tabview")); err == nil {
+			return n
+		}
+	}
+
+	return -1
+}
+
+func mouseClick(g *gocui.Gui, v *gocui.View) error {
+	cx, cy := v.Cursor()
+
+	switch v.Name() {
+	case "listing":
+		Listing.click(cx, cy)
+	case "tabbar":
+		if tab := Tabbar.tabAt(cx); tab != "" {
+			Tabbar.switchTo(tab)
+		}
+	default:
+		if n := paneNumber(v.Name()); n != -1 && n < len(Tabbar.panes) {
+			Tabbar.focus = n
+		}
+	}
+
+	return nil
+}
+
+func mouseWheel(dir int) gocui.KeybindingHandler {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		if v.Name() == "listing" {
+			if dir < 0 {
+				Listing.deliver(event{kind: LIST_UP, addr: wheelLines})
+			} else {
+				Listing.deliver(event{kind: LIST_DOWN, addr: wheelLines})
+			}
+			return nil
+		}
+
+		if n := paneNumber(v.Name()); n != -1 && n < len(Tabbar.panes) {
+			Tabbar.focus = n
+			if dir < 0 {
+				Tabbar.up()
+			} else {
+				Tabbar.down()
+			}
+		}
+		return nil
+	}
+}
+
+// click handles a click at column x of row y of the listing; it runs on
+// the gocui goroutine, so commands are handed over without waiting for
+// whatever the command line is busy with
+func (self *listing) click(x, y int) {
+	line := self.curLine + y
+	if y < 0 || line >= len(self.program) {
+		return
+	}
+
+	insn := &self.program[line]
+
+	// lines are "<< " and "0000: " and then the mnemonic and operands
+	operands := 3 + 6 + len(insn.Opcode) + 1
+	if r, ok := avrTable[strings.ToUpper(insn.Opcode)]; ok {
+		operands = 3 + 6 + len(r.M) + 1
+	}
+	if to, ok := self.target(insn); ok && x >= operands {
+		go CommandLine.deliver(event{kind: COMMAND, data: fmt.Sprintf("list 0x%x", to)})
+		return
+	}
+
+	for _, bp := range self.bps {
+		if int(bp) == insn.Offset {
+			go CommandLine.deliver(event{kind: COMMAND, data: fmt.Sprintf("clear 0x%x", insn.Offset)})
+			return
+		}
+	}
+
+	go CommandLine.deliver(event{kind: COMMAND, data: fmt.Sprintf("break 0x%x", insn.Offset)})
+}
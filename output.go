@@ -6,17 +6,28 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/jroimartin/gocui"
 )
 
+// The output tab shows what the device writes, in one of these modes:
+// raw, straight into the view; term, through a VT100 (see terminal.go);
+// escaped, with anything unprintable spelled out; or hex, as a hex dump.
+// "save output" always saves the raw bytes.
+var outputModes = []string{"raw", "term", "escaped", "hex"}
+
 type output struct {
 	c         chan event
 	contents  bytes.Buffer
 	written   int
 	lastFetch int
 	lastRun   int
+
+	// these belong to the gocui goroutine, like draw
+	mode string
+	term *terminal
 }
 
 func (self *output) deliver(e event) {
@@ -46,14 +57,66 @@ func (self *output) draw(v *gocui.View, refresh bool) {
 		self.written = 0
 	}
 
-	if self.written == self.contents.Len() {
+	n := self.contents.Len()
+	if self.written == n {
 		return
 	}
 
-	buf := self.contents.Bytes()
-	v.Write(buf[self.written:])
+	buf := self.contents.Bytes()[:n]
+
+	switch self.mode {
+	case "term":
+		self.term.write(buf[self.term.fed:])
+		v.Clear()
+		fmt.Fprint(v, self.term.String())
+	case "escaped":
+		fmt.Fprint(v, escapeBytes(buf[self.written:]))
+	case "hex":
+		v.Clear()
+		fmt.Fprint(v, hexdump(buf))
+	default:
+		v.Write(buf[self.written:])
+	}
+
+	self.written = n
+}
+
+// setMode switches modes, showing everything again in the new one; call it
+// on the gocui goroutine
+func (self *output) setMode(mode string) {
+	self.mode = mode
+	self.written = 0
+	if mode == "term" {
+		self.term = &terminal{}
+	}
+
+	if v := Tabbar.view("output"); v != nil {
+		v.Clear()
+	}
+	redraw()
+}
+
+func outputCommand(toks []string) bool {
+	if len(toks) < 2 {
+		onGui(func() {
+			mode := Output.mode
+			if mode == "" {
+				mode = "raw"
+			}
+			logf("output mode: %s", mode)
+		})
+		return true
+	}
 
-	self.written = self.contents.Len()
+	for _, mode := range outputModes {
+		if toks[1] == mode {
+			onGui(func() { Output.setMode(mode) })
+			return true
+		}
+	}
+
+	logf("output [%s]", strings.Join(outputModes, "|"))
+	return false
 }
 
 func (self *output) init() {
@@ -113,8 +176,9 @@ func (self *output) fetch() {
 	}
 
 	self.contents.Write(raw)
-	v, _ := g.View("tabview")
-	v.Autoscroll = true
+	if v := Tabbar.view("output"); v != nil {
+		v.Autoscroll = true
+	}
 }
 
 func (self *output) loop() {
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jroimartin/gocui"
+)
+
+// The "regs" tab: every register in hex, unsigned, signed and as a
+// character, the pointer pairs with what they point at, and SREG decoded a
+// flag at a time. Anything that changed since the previous stop is
+// highlighted.
+
+// regsPeek is how many bytes we show at each pointer
+const regsPeek = 8
+
+// sregFlags are SREG's flags from bit 7 down, which is the order the
+// emulator's sr_string has them in
+const sregFlags = "ITHSVNZC"
+
+type regs struct {
+	c       chan event
+	lock    sync.Mutex
+	cur     ApuState
+	prev    ApuState
+	ptrs    map[int][]byte // memory at X, Y and Z, by register number
+	past    *traceEntry
+	written bool
+}
+
+func (self *regs) deliver(e event) {
+	self.c <- e
+}
+
+func (self *regs) makechan() {
+	self.c = make(chan event)
+}
+
+// update takes a new CPU state; the one it replaces becomes "previous" if
+// the PC has moved, so re-polling a stopped device doesn't lose changes
+func (self *regs) update(cpu ApuState) {
+	ptrs := map[int][]byte{}
+	for _, r := range []int{26, 28, 30} {
+		ptrs[r] = peek(cpu.pair(r), regsPeek)
+	}
+
+	self.lock.Lock()
+	if cpu.Pc != self.cur.Pc || len(self.prev.Registers) == 0 {
+		self.prev = self.cur
+	}
+	self.cur = cpu
+	self.ptrs = ptrs
+	self.written = false
+	self.lock.Unlock()
+
+	redraw()
+}
+
+// sregFlag returns whether SREG flag f (counting from I, bit 7) is set
+func sregFlag(cpu *ApuState, f int) bool {
+	return cpu.sreg()&(0x80>>uint(f)) != 0
+}
+
+func printable(blob []byte) string {
+	out := &bytes.Buffer{}
+	for _, b := range blob {
+		if b >= 32 && b < 127 {
+			out.WriteByte(b)
+		} else {
+			out.WriteByte('.')
+		}
+	}
+	return out.String()
+}
+
+// hilite colors s as changed if changed is set
+func hilite(s string, changed bool) string {
+	if changed {
+		return color("changed", s)
+	}
+	return s
+}
+
+func (self *regs) draw(v *gocui.View, refresh bool) {
+	if refresh {
+		self.written = false
+	}
+
+	if self.written {
+		return
+	}
+
+	v.Clear()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	cur, prev := &self.cur, &self.prev
+	if len(cur.Registers) == 0 {
+		fmt.Fprintf(v, "no registers yet\n")
+		return
+	}
+
+	if self.past != nil {
+		fmt.Fprintf(v, "HISTORICAL STATE #%d\n", self.past.n)
+	}
+
+	cell := func(r int) string {
+		n := cur.reg(r)
+		c := printable([]byte{n})
+		s := fmt.Sprintf("r%-2d  %0.2x %3d %4d '%s'", r, n, n, int8(n), c)
+		return hilite(s, len(prev.Registers) > r && prev.reg(r) != n)
+	}
+
+	for r := 0; r < 16; r++ {
+		fmt.Fprintf(v, "%s      %s\n", cell(r), cell(r+16))
+	}
+
+	fmt.Fprintf(v, "\n")
+
+	for _, p := range []struct {
+		name string
+		r    int
+	}{{"X", 26}, {"Y", 28}, {"Z", 30}} {
+		addr := cur.pair(p.r)
+		s := fmt.Sprintf("%s  r%d:r%d  %0.4x", p.name, p.r+1, p.r, addr)
+		fmt.Fprintf(v, "%s", hilite(s, len(prev.Registers) > p.r+1 && prev.pair(p.r) != addr))
+
+		if sym := Listing.symbolize(int(addr)); sym != "??" {
+			fmt.Fprintf(v, " <%s>", sym)
+		}
+
+		if blob := self.ptrs[p.r]; self.past == nil && len(blob) > 0 {
+			hex := []string{}
+			for _, b := range blob {
+				hex = append(hex, fmt.Sprintf("%0.2x", b))
+			}
+			fmt.Fprintf(v, "  -> %s  |%s|", strings.Join(hex, " "), printable(blob))
+		}
+
+		fmt.Fprintf(v, "\n")
+	}
+
+	fmt.Fprintf(v, "\n%s\n", hilite(fmt.Sprintf("SP    %0.4x", cur.sp()), prev.Sp != "" && prev.sp() != cur.sp()))
+	fmt.Fprintf(v, "PC    %0.4x <%s>\n\n", cur.Pc, Listing.symbolize(cur.Pc))
+
+	fmt.Fprintf(v, "SREG  %0.2x   ", cur.sreg())
+	for i, f := range sregFlags {
+		set := sregFlag(cur, i)
+		s := fmt.Sprintf("%c=0", f)
+		if set {
+			s = fmt.Sprintf("%c=1", f)
+		}
+		fmt.Fprintf(v, "%s ", hilite(s, prev.Sr != "" && sregFlag(prev, i) != set))
+	}
+	fmt.Fprintf(v, "\n")
+
+	self.written = true
+}
+
+func (self *regs) loop() {
+	for {
+		e := <-self.c
+		switch e.kind {
+		case FETCH_LIVE:
+			if e.addr != self.cur.Pc || len(self.cur.Registers) == 0 {
+				self.update(CurrentStatus.stat.Cpu)
+			}
+		case HISTORY:
+			self.past = History.entry()
+			if self.past != nil {
+				self.update(self.past.stat().Cpu)
+			} else {
+				self.update(CurrentStatus.stat.Cpu)
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Memory snapshots: "snapshot save <name>" grabs all 64K of memory, and
+// "snapshot diff <a> <b>" lists the regions that differ between two of
+// them. Save one, feed the device some input, save another, and the diff
+// tells you where the input went.
+
+const (
+	// snapGap is how many unchanged bytes we'll fold into a changed
+	// region rather than starting a new one
+	snapGap = 4
+
+	// snapShow is how many bytes of each region we print
+	snapShow = 16
+
+	// snapRegions is the most regions we'll list
+	snapRegions = 64
+)
+
+type snapshot struct {
+	name  string
+	taken time.Time
+	pc    int
+	bytes []byte
+}
+
+var snapshots = map[string]*snapshot{}
+
+// takeSnapshot reads all of memory; it's 32 requests, so it isn't quick
+func takeSnapshot(name string) *snapshot {
+	blob := peekAll(0, 0x10000)
+	if blob == nil {
+		return nil
+	}
+
+	return &snapshot{
+		name:  name,
+		taken: time.Now(),
+		pc:    CurrentStatus.stat.Cpu.Pc,
+		bytes: blob,
+	}
+}
+
+// region is a run of changed bytes
+type region struct {
+	start, end int
+}
+
+func diffRegions(a, b []byte) (regions []region) {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+
+	for i := 0; i < n; i++ {
+		if a[i] == b[i] {
+			continue
+		}
+
+		if l := len(regions); l > 0 && i-regions[l-1].end <= snapGap {
+			regions[l-1].end = i + 1
+		} else {
+			regions = append(regions, region{i, i + 1})
+		}
+	}
+
+	return
+}
+
+// snapBytes renders a region's bytes as hex and, where it's printable,
+// text
+func snapBytes(blob []byte) string {
+	more := ""
+	if len(blob) > snapShow {
+		blob = blob[:snapShow]
+		more = " ..."
+	}
+
+	hex := &bytes.Buffer{}
+	text := &bytes.Buffer{}
+	for _, b := range blob {
+		fmt.Fprintf(hex, "%0.2x ", b)
+		if b >= 32 && b < 127 {
+			text.WriteByte(b)
+		} else {
+			text.WriteByte('.')
+		}
+	}
+
+	return fmt.Sprintf("%s%s |%s|", strings.TrimSpace(hex.String()), more, text.String())
+}
+
+func snapshotCommand(toks []string) bool {
+	if len(toks) < 2 {
+		logf("snapshot save <name> | diff <a> [b] | list | del <name>")
+		return false
+	}
+
+	switch toks[1] {
+	case "save":
+		if len(toks) < 3 || toks[2] == "live" {
+			logf("snapshot save <name> (and not \"live\")")
+			return false
+		}
+
+		snap := takeSnapshot(toks[2])
+		if snap == nil {
+			logf("couldn't read memory for snapshot")
+			return false
+		}
+
+		snapshots[snap.name] = snap
+		logf("saved snapshot %s at pc %0.4x", snap.name, snap.pc)
+
+	case "list":
+		names := []string{}
+		for name := range snapshots {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			snap := snapshots[name]
+			logf("%-16s pc %0.4x  %s", name, snap.pc, snap.taken.Format("15:04:05"))
+		}
+
+		if len(names) == 0 {
+			logf("no snapshots")
+		}
+
+	case "del", "delete":
+		if len(toks) < 3 {
+			logf("snapshot del <name>")
+			return false
+		}
+
+		if _, ok := snapshots[toks[2]]; !ok {
+			logf("no snapshot named %s", toks[2])
+			return false
+		}
+
+		delete(snapshots, toks[2])
+
+	case "diff":
+		if len(toks) < 3 {
+			logf("snapshot diff <a> [b]; b defaults to live memory")
+			return false
+		}
+
+		a, ok := snapshots[toks[2]]
+		if !ok {
+			logf("no snapshot named %s", toks[2])
+			return false
+		}
+
+		var b *snapshot
+		if len(toks) < 4 || toks[3] == "live" {
+			if b = takeSnapshot("live"); b == nil {
+				logf("couldn't read memory")
+				return false
+			}
+		} else if b, ok = snapshots[toks[3]]; !ok {
+			logf("no snapshot named %s", toks[3])
+			return false
+		}
+
+		snapshotDiff(a, b)
+
+	default:
+		logf("snapshot save <name> | diff <a> [b] | list | del <name>")
+		return false
+	}
+
+	return true
+}
+
+func snapshotDiff(a, b *snapshot) {
+	regions := diffRegions(a.bytes, b.bytes)
+
+	// regions take in small unchanged gaps, so count the bytes themselves
+	changed := 0
+	for _, r := range regions {
+		for i := r.start; i < r.end; i++ {
+			if a.bytes[i] != b.bytes[i] {
+				changed++
+			}
+		}
+	}
+
+	logf("%s -> %s: %d regions, %d bytes changed", a.name, b.name, len(regions), changed)
+
+	for i, r := range regions {
+		if i == snapRegions {
+			logf("... and %d more", len(regions)-i)
+			break
+		}
+
+		logf("%0.4x-%0.4x (%d)", r.start, r.end-1, r.end-r.start)
+		logf("    - %s", snapBytes(a.bytes[r.start:r.end]))
+		logf("    + %s", snapBytes(b.bytes[r.start:r.end]))
+	}
+
+	logf("")
+}
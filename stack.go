@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"strconv"
 	"time"
 
 	"github.com/jroimartin/gocui"
@@ -13,12 +12,16 @@ type stack struct {
 	live     chan bool
 	demand   chan bool
 	contents []byte
+	prev     []byte // contents at the last update, at prevaddr
+	prevaddr uint16
 	written  bool
-	sx, sy   int
+	viewSize
 	lastsp   uint16
 	lastaddr uint16
 	lastpc   uint16
 	bump     int
+	past     *traceEntry
+	frames   []frame
 }
 
 func (self *stack) deliver(e event) {
@@ -34,61 +37,156 @@ func (self *stack) draw(v *gocui.View, refresh bool) {
 		self.written = false
 	}
 
+	if self.resized(v) {
+		self.written = false
+		go self.deliver(event{kind: RESIZE})
+	}
+
 	if self.written {
 		return
 	}
 
 	v.Clear()
 
-	self.sx, self.sy = v.Size()
+	contents, base, sp := self.contents, self.lastaddr, self.lastsp
+	if self.past != nil {
+		contents, base, sp = self.past.stack.bytes, self.past.stack.addr, self.past.sp
+		fmt.Fprintf(v, "HISTORICAL STATE #%d\n", self.past.n)
+	}
+
+	// what we know about the live stack from unwinding it: where each
+	// frame's return address is, and which registers its prologue saved
+	rets := map[uint16]int{}
+	saved := map[uint16]string{}
+
+	if self.past == nil && len(self.frames) > 0 {
+		for i, f := range self.frames {
+			fmt.Fprintf(v, "#%d %s\n", i, f.String())
+
+			if f.retAt != 0 {
+				rets[f.retAt] = i
+			}
+
+			for at, r := range f.saved {
+				saved[at] = fmt.Sprintf("r%d (saved by #%d)", r, i)
+			}
+		}
+		fmt.Fprintf(v, "\n")
+	}
+
+	// hex formats the n bytes at off, colored if any changed since the
+	// last update
+	hex := func(off, n int) string {
+		s := fmt.Sprintf("%0.2x", contents[off])
+		if n == 2 {
+			s = fmt.Sprintf("%0.2x%0.2x", contents[off], contents[off+1])
+		}
 
-	blob := self.contents[self.bump:]
+		if self.past != nil {
+			return s
+		}
 
-	for off, b := range blob {
-		cur := self.lastaddr + uint16(off) + uint16(self.bump)
-		if off%2 == 0 {
-			if cur == self.lastsp {
-				fmt.Fprintf(v, "%0.4x:>>    ", cur)
-			} else {
-				fmt.Fprintf(v, "%0.4x:      ", cur)
+		for i := off; i < off+n; i++ {
+			at := int(base) + i - int(self.prevaddr)
+			if at >= 0 && at < len(self.prev) && self.prev[at] != contents[i] {
+				return color("changed", s)
 			}
+		}
+		return s
+	}
+
+	boundary := func(i int) {
+		if i < len(self.frames) {
+			fmt.Fprintf(v, "---- #%d <%s> ----\n", i, Listing.symbolize(self.frames[i].pc))
+		}
+	}
+
+	// rows are a byte or a word; annotated things get rows to themselves,
+	// and everything else is paired up, starting "bump" bytes in
+	for off := self.bump; off < len(contents); {
+		cur := base + uint16(off)
 
-			fmt.Fprintf(v, "%0.2x", b)
+		if cur == sp+1 && self.past == nil {
+			boundary(0)
+		}
+
+		word := -1
+		if off+1 < len(contents) {
+			word = int(contents[off])<<8 | int(contents[off+1])
+		}
+
+		mark := "  "
+		if cur == sp || (word != -1 && cur+1 == sp) {
+			mark = ">>"
+		}
+
+		if i, ok := rets[cur]; ok && word != -1 {
+			code := Listing.codeAddr(word)
+			fmt.Fprintf(v, "%0.4x:%s    %s  return from #%d to 0x%0.4x <%s>\n", cur, mark, hex(off, 2), i, code, Listing.symbolize(code))
+			boundary(i + 1)
+			off += 2
+			continue
+		}
+
+		if note, ok := saved[cur]; ok {
+			fmt.Fprintf(v, "%0.4x:%s    %s    %s\n", cur, mark, hex(off, 1), note)
+			off++
+			continue
+		}
+
+		_, nextSaved := saved[cur+1]
+		_, nextRet := rets[cur+1]
+		if word == -1 || nextSaved || nextRet || cur == sp {
+			fmt.Fprintf(v, "%0.4x:%s    %s\n", cur, mark, hex(off, 1))
+			off++
+			continue
+		}
+
+		if code := Listing.codeAddr(word); isReturn(code) {
+			fmt.Fprintf(v, "%0.4x:%s    %s  -> 0x%0.4x <%s>?\n", cur, mark, hex(off, 2), code, Listing.symbolize(code))
 		} else {
-			fmt.Fprintf(v, "%0.2x\n", b)
+			fmt.Fprintf(v, "%0.4x:%s    %s\n", cur, mark, hex(off, 2))
 		}
+		off += 2
 	}
 
 	self.written = true
 }
 
+// window returns the range of memory the stack tab shows around sp
+func (self *stack) window(sp uint16) (addr uint16, size int) {
+	size = self.sy * 2
+	if size == 0 {
+		size = 16 * 4
+	}
+
+	if sp > uint16(size) {
+		addr = sp - (uint16(size) / 2)
+	}
+
+	return
+}
+
 func (self *stack) update() {
-	size := self.sy * 2
+	var size int
 
-	a, _ := strconv.ParseUint(CurrentStatus.stat.Cpu.Sp, 16, 16)
-	self.lastsp = uint16(a)
+	self.lastsp = CurrentStatus.stat.Cpu.sp()
 	if self.lastsp != 0 {
-		if self.lastsp > uint16(size) {
-			self.lastaddr = self.lastsp - (uint16(size) / 2)
-			if self.lastpc%2 == 0 {
-				self.lastaddr += 1
-			}
-		} else {
-			self.lastaddr = 0
+		self.prev, self.prevaddr = self.contents, self.lastaddr
+
+		self.lastaddr, size = self.window(self.lastsp)
+		if self.lastaddr != 0 && self.lastpc%2 == 0 {
+			self.lastaddr += 1
 		}
 
 		self.contents = peek(self.lastaddr, size)
+		self.frames = backtrace(&CurrentStatus.stat.Cpu, true)
 		self.written = false
 		redraw()
 	}
 }
 
 func (self *stack) init() {
-	time.Sleep(2 * time.Second)
-
-	v, _ := g.View("tabview")
-	self.sx, self.sy = v.Size()
-
 	// rate limit live updates
 	self.live = make(chan bool)
 	go func() {
@@ -141,6 +239,15 @@ func (self *stack) loop() {
 				self.lastpc = uint16(e.addr)
 				self.live <- true
 			}
+		case RESIZE:
+			self.update()
+		case HISTORY:
+			self.past = History.entry()
+			if self.past == nil {
+				self.update()
+			}
+			self.written = false
+			redraw()
 		case STACK_BUMP:
 			self.bump = (self.bump + 1) % 2
 			self.written = false
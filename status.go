@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jroimartin/gocui"
@@ -19,6 +21,13 @@ var statuses = []string{
 type status struct {
 	c    chan event
 	stat StatMsg
+
+	// for the second line of the status bar
+	polled     time.Time // when stat was fetched
+	changed    time.Time // when the PC, cycles or status last changed
+	stopCycles int       // cycle count at the last stop
+	delta      int       // cycles run between the last two stops
+	ips        float64   // how fast it was going at the last poll
 }
 
 func (self *status) init() {
@@ -32,35 +41,59 @@ func (self *status) init() {
 	}()
 }
 
-func (self *status) update() {
-        fail := false
-
+// fetchStatus reads /device/status without touching the UI; components that
+// need to look at the CPU between steps use this instead of waiting on the
+// status bar
+func fetchStatus() (stat StatMsg, err error) {
 	x, err := Session.get("/device/status")
-	if err != nil { 
- 		fail = true
-	}	
-	err = json.Unmarshal(x.body, &self.stat)
-	if err != nil { 
- 		fail = true
+	if err != nil {
+		return
 	}
 
-	if fail { 
+	err = json.Unmarshal(x.body, &stat)
+	return
+}
+
+func (self *status) update() {
+	stat, err := fetchStatus()
+	if err != nil {
 		withViewNamed("status", func(v *gocui.View) {
 			v.Clear()
 			fmt.Fprintf(v, "can't reach emulator")
 		})
 		return
-	}	
+	}
 
+	self.track(&stat)
+	self.stat = stat
+	Trace.record(&self.stat)
+	settleTempBreakpoints(&self.stat)
+
+	// don't paint over a historical state someone is looking at
+	if History.active() {
+		return
+	}
+
+	self.render(&self.stat, "")
+
+	Listing.deliver(event{kind: LIST_ADDR_LIVE, addr: self.stat.Cpu.Pc})
+	Dump.deliver(event{kind: FETCH_LIVE, addr: self.stat.Cpu.Pc})
+	Stack.deliver(event{kind: FETCH_LIVE, addr: self.stat.Cpu.Pc})
+	Watches.deliver(event{kind: FETCH_LIVE, addr: self.stat.Cpu.Pc})
+	Regs.deliver(event{kind: FETCH_LIVE, addr: self.stat.Cpu.Pc})
+}
+
+// render draws stat in the status bar, prefixed with label
+func (self *status) render(stat *StatMsg, label string) {
 	withViewNamed("status", func(v *gocui.View) {
 		v.Clear()
 		s := statuses[0]
-		if self.stat.Status > 0 && self.stat.Status < len(statuses) {
-			s = statuses[self.stat.Status]
+		if stat.Status > 0 && stat.Status < len(statuses) {
+			s = statuses[stat.Status]
 		}
-		fmt.Fprintf(v, "status: %s pc:%0.4x [%s] ", s, self.stat.Cpu.Pc, self.stat.Cpu.Sr)
+		fmt.Fprintf(v, "%sstatus: %s pc:%0.4x [%s] ", label, s, stat.Cpu.Pc, stat.Cpu.Sr)
 
-		for i, reg := range self.stat.Cpu.Registers {
+		for i, reg := range stat.Cpu.Registers {
 			switch i {
 			case 8, 16, 24:
 				fmt.Fprintf(v, " %.2d:", i)
@@ -68,11 +101,73 @@ func (self *status) update() {
 			fmt.Fprintf(v, "%s", reg)
 		}
 		fmt.Fprintf(v, "\n")
+
+		insn := stat.Cpu.CurrentInsn
+		if i := Listing.insnAt(stat.Cpu.Pc); i != nil {
+			insn = i.String()
+		}
+		insn = fmt.Sprintf("%s <%s>", insn, Listing.symbolize(stat.Cpu.Pc))
+
+		// recorded states don't have any of the rest
+		if label != "" {
+			fmt.Fprintf(v, "%s", insn)
+			return
+		}
+
+		fmt.Fprintf(v, "cycles:%d (+%d)", stat.Cpu.Cycles, self.delta)
+		if stat.Status == 2 {
+			fmt.Fprintf(v, " %s ips", humanize(self.ips))
+		}
+		fmt.Fprintf(v, "  run:%d  %s", stat.RunCount, insn)
+
+		sleeping := []string{}
+		for i, asleep := range stat.AsnSleeping {
+			if asleep {
+				sleeping = append(sleeping, strconv.Itoa(i))
+			}
+		}
+		if len(sleeping) > 0 {
+			fmt.Fprintf(v, "  asleep:%s", strings.Join(sleeping, ","))
+		}
+
+		if !self.changed.IsZero() {
+			fmt.Fprintf(v, "  (changed %s ago)", time.Since(self.changed)/time.Second*time.Second)
+		}
 	})
+}
 
-	Listing.deliver(event{kind: LIST_ADDR_LIVE, addr: self.stat.Cpu.Pc})
-	Dump.deliver(event{kind: FETCH_LIVE, addr: self.stat.Cpu.Pc})
-	Stack.deliver(event{kind: FETCH_LIVE, addr: self.stat.Cpu.Pc})
+// track updates the timing and cycle numbers for the status bar from a new
+// status, before it replaces the old one
+func (self *status) track(stat *StatMsg) {
+	now := time.Now()
+	old := &self.stat
+
+	if stat.Cpu.Pc != old.Cpu.Pc || stat.Cpu.Cycles != old.Cpu.Cycles || stat.Status != old.Status {
+		self.changed = now
+	}
+
+	// the emulator's "cycles" counts instructions
+	self.ips = 0
+	if dt := now.Sub(self.polled).Seconds(); !self.polled.IsZero() && dt > 0 && stat.Cpu.Cycles > old.Cpu.Cycles {
+		self.ips = float64(stat.Cpu.Cycles-old.Cpu.Cycles) / dt
+	}
+	self.polled = now
+
+	if stat.Status != 2 && stat.Cpu.Cycles != self.stopCycles {
+		self.delta = stat.Cpu.Cycles - self.stopCycles
+		self.stopCycles = stat.Cpu.Cycles
+	}
+}
+
+// humanize abbreviates big numbers: 1234567 is 1.2M
+func humanize(n float64) string {
+	switch {
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fM", n/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1fk", n/1e3)
+	}
+	return fmt.Sprintf("%.0f", n)
 }
 
 func (self *status) loop() {
@@ -100,16 +195,61 @@ func updateStatus() {
 }
 
 type ApuState struct {
-	Pc        int      `json:"pc"`
-	Sp        string   `json:"sp"`
-	Sr        string   `json:"sr_string"`
-	Cycles    int      `json:"cycles"`
-	Registers []string `json:"registers"`
+	Pc          int      `json:"pc"`
+	PcString    string   `json:"pc_string"`
+	Sp          string   `json:"sp"`
+	Sr          string   `json:"sr_string"`
+	SrVal       int      `json:"sr"`
+	Cycles      int      `json:"cycles"`
+	CurrentInsn string   `json:"current_insn"`
+	Registers   []string `json:"registers"`
+}
+
+// reg returns the value of register n
+func (self *ApuState) reg(n int) uint8 {
+	if n < 0 || n >= len(self.Registers) {
+		return 0
+	}
+
+	v, _ := strconv.ParseUint(self.Registers[n], 16, 8)
+	return uint8(v)
+}
+
+// pair returns the word in registers n+1:n (X is pair(26), Y is pair(28),
+// Z is pair(30))
+func (self *ApuState) pair(n int) uint16 {
+	return uint16(self.reg(n+1))<<8 | uint16(self.reg(n))
+}
+
+// sreg returns SREG. The emulator sends it twice, as "sr" and as "sr_string"
+// (the flags from I down to C, upper case if they're set), and the two don't
+// always agree; we go by the string, like the regs tab's flags always have,
+// and only use the number when there's no string.
+func (self *ApuState) sreg() uint8 {
+	if len(self.Sr) != len(sregFlags) {
+		return uint8(self.SrVal)
+	}
+
+	var v uint8
+	for i, c := range self.Sr {
+		if c >= 'A' && c <= 'Z' {
+			v |= 0x80 >> uint(i)
+		}
+	}
+	return v
+}
+
+// sp returns the stack pointer as a number
+func (self *ApuState) sp() uint16 {
+	v, _ := strconv.ParseUint(self.Sp, 16, 16)
+	return uint16(v)
 }
 
 type StatMsg struct {
-	Cpu    ApuState `json:"apu_state"`
-	Status int      `json:"status"`
+	Cpu         ApuState `json:"apu_state"`
+	Status      int      `json:"status"`
+	RunCount    int      `json:"runcount"`
+	AsnSleeping []bool   `json:"asnSleeping"`
 }
 
 // {
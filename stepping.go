@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Stepping commands built out of the emulator's runto and breakpoint calls:
+// "stepover" runs to the instruction after a call, "finish" runs to the
+// current function's return address, and "until" runs to an address but
+// also stops if the current function returns first. That last one needs a
+// second stopping point, so it sets a temporary breakpoint on the return
+// address, which goes away the first time we see the device stopped after
+// it has executed something, whether the status poll sees it or we check
+// before running again. If the user sets a breakpoint there in the
+// meantime, it becomes theirs and stays.
+
+// returnScan is how far above SP we'll look for a return address
+const returnScan = 64
+
+var (
+	tempLock   sync.Mutex
+	tempBps    []uint16
+	tempCycles int // the cycle count when they were set
+)
+
+// runTo lets the device run until it reaches addr, returning false if the
+// device wouldn't
+func runTo(addr int) bool {
+	History.live()
+	checkTempBreakpoints()
+
+	if on, _ := Trace.tracing(); on && !Watcher.isRunning() {
+		Watcher.deliver(event{kind: WATCH_RUN, addr: addr})
+		return true
+	}
+
+	res, err := Session.post(fmt.Sprintf("/device/runto/%d", addr), "")
+	if !res.HTTPOK(err) {
+		return false
+	}
+
+	logf("running to %0.4x", addr)
+	return true
+}
+
+// isReturn is true if addr (in listing units) is just after a call, which
+// is the only place a return address can point
+func isReturn(addr int) bool {
+	line, ok := Listing.lindex[addr]
+	if !ok || line == 0 {
+		return false
+	}
+
+	return Listing.program[line-1].isCall()
+}
+
+// findReturn scans upward from SP for the first word on the stack that
+// looks like a return address; at the top of a function that's the word
+// right at SP, but after the prologue has pushed registers and made room
+// for locals it's further up
+func findReturn(cpu *ApuState) (ret int, at uint16, ok bool) {
+	sp := cpu.sp()
+
+	blob := peek(sp+1, returnScan)
+	for i := 0; i+1 < len(blob); i++ {
+		// CALL pushes the low byte first, so the high byte ends up lower
+		ret = Listing.codeAddr(int(blob[i])<<8 | int(blob[i+1]))
+		if isReturn(ret) {
+			return ret, sp + 1 + uint16(i), true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// stepOver steps, unless we're at a call, in which case it runs until the
+// call returns
+func stepOver() bool {
+	stat, err := fetchStatus()
+	if err != nil {
+		logError("stepover", err)
+		return false
+	}
+
+	insn := Listing.insnAt(stat.Cpu.Pc)
+	next := Listing.next(stat.Cpu.Pc)
+
+	if insn == nil || !insn.isCall() || next == -1 {
+		History.live()
+		checkTempBreakpoints()
+		res, err := Session.post("/device/step", "")
+		if !res.OK(err) {
+			return false
+		}
+		updateStatus()
+		return true
+	}
+
+	return runTo(next)
+}
+
+// finish runs until the current function returns
+func finish() bool {
+	stat, err := fetchStatus()
+	if err != nil {
+		logError("finish", err)
+		return false
+	}
+
+	ret, at, ok := findReturn(&stat.Cpu)
+	if !ok {
+		logf("can't find a return address on the stack")
+		return false
+	}
+
+	logf("return address %0.4x (at %0.4x on the stack)", ret, at)
+	return runTo(ret)
+}
+
+// until runs to addr, but stops early if the current function returns
+func until(addr int) bool {
+	stat, err := fetchStatus()
+	if err != nil {
+		logError("until", err)
+		return false
+	}
+
+	if ret, _, ok := findReturn(&stat.Cpu); ok && ret != addr {
+		if addTempBreakpoint(uint16(ret), stat.Cpu.Cycles) {
+			logf("will also stop at return address %0.4x", ret)
+		}
+	} else if !ok {
+		logf("can't find a return address; only stopping at %0.4x", addr)
+	}
+
+	return runTo(addr)
+}
+
+// addTempBreakpoint sets a breakpoint that goes away once the device has
+// run past cycles and stopped; if there's already a real breakpoint at addr,
+// we leave it alone
+func addTempBreakpoint(addr uint16, cycles int) bool {
+	for _, bp := range allBreakpoints() {
+		if bp == addr {
+			return true
+		}
+	}
+
+	res, err := Session.put(fmt.Sprintf("/device/breakpoints/%d", addr), "")
+	if !res.HTTPOK(err) {
+		return false
+	}
+
+	tempLock.Lock()
+	tempBps = append(tempBps, addr)
+	tempCycles = cycles
+	tempLock.Unlock()
+
+	Listing.deliver(event{kind: REFRESH_BPS})
+	return true
+}
+
+// settleTempBreakpoints is called with every status we fetch; if the device
+// is stopped and has executed something since the temporary breakpoints
+// were set, they've done their job. This doesn't depend on catching the
+// device running, which a short run can finish between polls.
+func settleTempBreakpoints(stat *StatMsg) {
+	tempLock.Lock()
+	done := len(tempBps) > 0 && stat.Status != 2 && stat.Cpu.Cycles != tempCycles
+	tempLock.Unlock()
+
+	if done {
+		clearTempBreakpoints()
+	}
+}
+
+// checkTempBreakpoints settles temporary breakpoints against the device as
+// it is now; commands that run the device call it first, so one left over
+// from a finished "until" can't stop them
+func checkTempBreakpoints() {
+	tempLock.Lock()
+	n := len(tempBps)
+	tempLock.Unlock()
+
+	if n == 0 {
+		return
+	}
+
+	if stat, err := fetchStatus(); err == nil {
+		settleTempBreakpoints(&stat)
+	}
+}
+
+// keepBreakpoint is called when the user sets a breakpoint at addr; if it's
+// one of ours, it's theirs now, and clearing ours mustn't delete it
+func keepBreakpoint(addr uint16) {
+	tempLock.Lock()
+	defer tempLock.Unlock()
+
+	for i, bp := range tempBps {
+		if bp == addr {
+			tempBps = append(tempBps[:i], tempBps[i+1:]...)
+			return
+		}
+	}
+}
+
+// clearTempBreakpoints deletes all the temporary breakpoints
+func clearTempBreakpoints() {
+	tempLock.Lock()
+	bps := tempBps
+	tempBps = nil
+	tempLock.Unlock()
+
+	if len(bps) == 0 {
+		return
+	}
+
+	for _, addr := range bps {
+		res, err := Session.del(fmt.Sprintf("/device/breakpoints/%d", addr))
+		res.HTTPOK(err)
+	}
+
+	Listing.deliver(event{kind: REFRESH_BPS})
+}
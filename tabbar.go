@@ -9,56 +9,256 @@ import (
 
 type tabfn func(v *gocui.View, refresh bool)
 
+// A pane is one of the views the main area is split into; each shows a
+// tab. Panes are laid out in rows or columns, sized by weight.
+type pane struct {
+	tab    string
+	weight int
+	shown  string // the tab drawn in it last time
+}
+
+// paneWeight is what a new pane weighs; "pane grow" and "pane shrink"
+// change it a step at a time
+const (
+	paneWeight = 10
+	paneStep   = 2
+)
+
 type tabbar struct {
-	options        []string
-	handlers       map[string]tabfn
-	selected, last int
+	options  []string
+	handlers map[string]tabfn
+
+	panes     []*pane
+	focus     int  // the pane tab switching applies to
+	cols      bool // panes side by side instead of stacked
+	listWidth int  // percent of the screen the listing gets
 }
 
 func (self *tabbar) renderBar(v *gocui.View) {
 	v.Clear()
 
-	for i, vs := range self.options {
-		if i == self.selected {
+	for _, vs := range self.options {
+		switch {
+		case vs == self.current():
 			fmt.Fprintf(v, " [%s]", strings.ToUpper(vs))
-		} else {
+		case self.paneShowing(vs) != -1:
+			fmt.Fprintf(v, " (%s)", vs)
+		default:
 			fmt.Fprintf(v, " %s", vs)
 		}
 	}
 }
 
+// tabAt returns the tab whose name is at column x of the tab bar
+func (self *tabbar) tabAt(x int) string {
+	at := 0
+	for _, vs := range self.options {
+		width := 1 + len(vs)
+		if vs == self.current() || self.paneShowing(vs) != -1 {
+			width += 2
+		}
+
+		if x >= at && x < at+width {
+			return vs
+		}
+		at += width
+	}
+	return ""
+}
+
+// paneShowing returns which pane has tab in it, or -1
+func (self *tabbar) paneShowing(tab string) int {
+	for i, p := range self.panes {
+		if p.tab == tab {
+			return i
+		}
+	}
+	return -1
+}
+
+// viewName is the gocui view for pane n; the first is "tabview"
+func viewName(n int) string {
+	if n == 0 {
+		return "tabview"
+	}
+	return fmt.Sprintf("tabview%d", n)
+}
+
+// viewSize is the size of the view a tab was last drawn in, for the tabs
+// (dump and stack) where how much they fetch depends on it
+type viewSize struct {
+	sx, sy int
+}
+
+// resized records v's size and says whether it changed, in which case
+// the tab should fetch again
+func (self *viewSize) resized(v *gocui.View) bool {
+	sx, sy := v.Size()
+	if sx == self.sx && sy == self.sy {
+		return false
+	}
+	self.sx, self.sy = sx, sy
+	return true
+}
+
+// view returns the view showing tab, or nil if it isn't showing
+func (self *tabbar) view(tab string) *gocui.View {
+	if n := self.paneShowing(tab); n != -1 {
+		v, _ := g.View(viewName(n))
+		return v
+	}
+	return nil
+}
+
+// nextTab shows the next tab that isn't already in another pane
 func (self *tabbar) nextTab() {
-	self.selected = (self.selected + 1) % len(self.options)
+	i := 0
+	for i < len(self.options) && self.options[i] != self.current() {
+		i++
+	}
+
+	for n := 1; n < len(self.options); n++ {
+		next := self.options[(i+n)%len(self.options)]
+		if self.paneShowing(next) == -1 {
+			self.panes[self.focus].tab = next
+			return
+		}
+	}
 }
 
+// switchTo shows a tab in the focused pane, or focuses the pane it's
+// already showing in
 func (self *tabbar) switchTo(which string) {
-	for i, v := range self.options {
-		if v == which {
-			self.selected = i
-			redraw()
-			return
+	if _, ok := self.handlers[which]; !ok {
+		return
+	}
+
+	if n := self.paneShowing(which); n != -1 {
+		self.focus = n
+	} else {
+		self.panes[self.focus].tab = which
+	}
+	redraw()
+}
+
+// split adds a pane after the focused one, showing tab (or the next tab
+// nobody's looking at) and focuses it
+func (self *tabbar) split(tab string) {
+	if tab == "" {
+		for _, o := range self.options {
+			if self.paneShowing(o) == -1 {
+				tab = o
+				break
+			}
 		}
 	}
+
+	if _, ok := self.handlers[tab]; !ok {
+		logf("no tab named '%s'", tab)
+		return
+	}
+
+	if self.paneShowing(tab) != -1 {
+		logf("%s is already showing", tab)
+		return
+	}
+
+	n := self.focus + 1
+	self.panes = append(self.panes[:n], append([]*pane{{tab: tab, weight: paneWeight}}, self.panes[n:]...)...)
+	self.focus = n
+	self.reset()
+}
+
+// close removes pane n, unless it's the last one
+func (self *tabbar) close(n int) {
+	if len(self.panes) == 1 {
+		logf("can't close the only pane")
+		return
+	}
+
+	self.panes = append(self.panes[:n], self.panes[n+1:]...)
+	if self.focus >= len(self.panes) {
+		self.focus = len(self.panes) - 1
+	}
+	self.reset()
+}
+
+// only closes every pane but the focused one
+func (self *tabbar) only() {
+	self.panes = []*pane{self.panes[self.focus]}
+	self.focus = 0
+	self.reset()
+}
+
+// grow changes the focused pane's weight by n steps
+func (self *tabbar) grow(n int) {
+	p := self.panes[self.focus]
+	p.weight += n * paneStep
+	if p.weight < paneStep {
+		p.weight = paneStep
+	}
+	redraw()
+}
+
+// reset makes every pane redraw from scratch, since views get renumbered
+// when panes come and go. Like everything that changes the panes, it has to
+// happen on the gocui goroutine.
+func (self *tabbar) reset() {
+	for n := len(self.panes); ; n++ {
+		if err := g.DeleteView(viewName(n)); err != nil {
+			break
+		}
+	}
+
+	for _, p := range self.panes {
+		p.shown = ""
+	}
+	redraw()
 }
 
+// renderView lays the panes out in the given rectangle and draws them
 func (self *tabbar) renderView(sx, sy, ex, ey int) {
 	bar, _ := g.View("tabbar")
 	self.renderBar(bar)
 
-	v, err := g.SetView("tabview", sx, sy, ex, ey)
-	if err != nil {
-		v.Editable = true
+	total := 0
+	for _, p := range self.panes {
+		total += p.weight
 	}
 
-	refresh := false
-	if self.selected != self.last {
-		v.Clear()
-		v.SetOrigin(0, 0)
-		refresh = true
-		self.last = self.selected
-	}
+	at := 0
+	for n, p := range self.panes {
+		x0, y0, x1, y1 := sx, sy, ex, ey
+		if self.cols {
+			x0, x1 = sx+(ex-sx)*at/total, sx+(ex-sx)*(at+p.weight)/total
+		} else {
+			y0, y1 = sy+(ey-sy)*at/total, sy+(ey-sy)*(at+p.weight)/total
+		}
+		at += p.weight
 
-	self.handlers[self.options[self.selected]](v, refresh)
+		v, err := g.SetView(viewName(n), x0, y0, x1, y1)
+		if err != nil {
+			v.Editable = true
+		}
+
+		v.Title = ""
+		if len(self.panes) > 1 {
+			v.Title = fmt.Sprintf("%d %s", n+1, p.tab)
+			if n == self.focus {
+				v.Title = fmt.Sprintf("%d *%s*", n+1, p.tab)
+			}
+		}
+
+		refresh := false
+		if p.tab != p.shown {
+			v.Clear()
+			v.SetOrigin(0, 0)
+			refresh = true
+			p.shown = p.tab
+		}
+
+		self.handlers[p.tab](v, refresh)
+	}
 }
 
 // BUG(tqbf): obviously clean this up
@@ -97,6 +297,24 @@ func renderStack(v *gocui.View, refresh bool) {
 	Stack.draw(v, refresh)
 }
 
+func renderRegs(v *gocui.View, refresh bool) {
+	v.Wrap = false
+	v.Autoscroll = false
+	Regs.draw(v, refresh)
+}
+
+func renderTrace(v *gocui.View, refresh bool) {
+	v.Wrap = false
+	v.Autoscroll = true
+	Trace.draw(v, refresh)
+}
+
+func renderWatches(v *gocui.View, refresh bool) {
+	v.Wrap = false
+	v.Autoscroll = false
+	Watches.draw(v, refresh)
+}
+
 func renderHelp(v *gocui.View, refresh bool) {
 	v.Wrap = true
 	v.Autoscroll = false
@@ -104,12 +322,18 @@ func renderHelp(v *gocui.View, refresh bool) {
 }
 
 func (self *tabbar) current() string {
-	return self.options[self.selected]
+	return self.panes[self.focus].tab
+}
+
+// focused is the focused pane's view
+func (self *tabbar) focused() *gocui.View {
+	v, _ := g.View(viewName(self.focus))
+	return v
 }
 
 func (self *tabbar) bottom() {
 	g.Execute(func(g *gocui.Gui) error {
-		v, _ := g.View("tabview")
+		v := self.focused()
 		cx, _ := v.Cursor()
 		_, sy := v.Size()
 		lines := strings.Count(v.Buffer(), "\n")
@@ -133,7 +357,7 @@ func (self *tabbar) down() {
 	}
 
 	g.Execute(func(g *gocui.Gui) error {
-		v, _ := g.View("tabview")
+		v := self.focused()
 		cx, cy := v.Cursor()
 		_, sy := v.Size()
 		v.Autoscroll = false
@@ -155,7 +379,7 @@ func (self *tabbar) up() {
 	}
 
 	g.Execute(func(*gocui.Gui) error {
-		v, _ := g.View("tabview")
+		v := self.focused()
 		ox, oy := v.Origin()
 		cx, cy := v.Cursor()
 		v.Autoscroll = false
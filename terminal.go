@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A little VT100, for the output tab's "term" mode. It keeps every line
+// the device has written (so there's scrollback), with the bottom
+// termRows of them being the "screen" that cursor addressing works in. The
+// cursor can't leave the screen, and lines wrap at termCols, like a real
+// terminal; the device can't make us allocate more than it writes. It
+// knows CR, LF, backspace, tab and form feed, and the escapes people
+// actually use: cursor movement and positioning, erasing the screen and
+// lines, save/restore cursor, and colors, which are passed on to gocui.
+// Anything else is swallowed.
+
+const (
+	termRows = 24
+	termCols = 80
+)
+
+type cell struct {
+	ch  rune
+	sgr string // color escapes in effect
+}
+
+type terminal struct {
+	lines    [][]cell
+	row, col int
+	sgr      string
+	saveRow  int
+	saveCol  int
+	esc      []byte // escape sequence we're in the middle of
+	fed      int    // bytes of output we've seen
+}
+
+// top is the line the screen starts on
+func (self *terminal) top() int {
+	if len(self.lines) > termRows {
+		return len(self.lines) - termRows
+	}
+	return 0
+}
+
+func (self *terminal) line() []cell {
+	for len(self.lines) <= self.row {
+		self.lines = append(self.lines, nil)
+	}
+	return self.lines[self.row]
+}
+
+// clamp keeps the cursor on the screen
+func (self *terminal) clamp() {
+	top := self.top()
+	if self.row < top {
+		self.row = top
+	}
+	if self.row > top+termRows-1 {
+		self.row = top + termRows - 1
+	}
+
+	if self.col < 0 {
+		self.col = 0
+	}
+	if self.col > termCols-1 {
+		self.col = termCols - 1
+	}
+}
+
+func (self *terminal) put(ch rune) {
+	if self.col >= termCols {
+		self.row++
+		self.col = 0
+	}
+
+	line := self.line()
+	for len(line) <= self.col {
+		line = append(line, cell{ch: ' '})
+	}
+	line[self.col] = cell{ch: ch, sgr: self.sgr}
+	self.lines[self.row] = line
+	self.col++
+}
+
+func (self *terminal) clear() {
+	self.row -= self.top()
+	self.lines = nil
+}
+
+// write feeds the terminal output
+func (self *terminal) write(buf []byte) {
+	for _, b := range buf {
+		self.feed(b)
+	}
+	self.fed += len(buf)
+}
+
+func (self *terminal) feed(b byte) {
+	if self.esc != nil {
+		self.esc = append(self.esc, b)
+		if escDone(self.esc) {
+			self.escape(self.esc)
+			self.esc = nil
+		} else if len(self.esc) > 64 {
+			self.esc = nil // not something we understand
+		}
+		return
+	}
+
+	switch {
+	case b == 0x1b:
+		self.esc = []byte{b}
+	case b == '\r':
+		self.col = 0
+	case b == '\n':
+		// as if the tty did CR too, which it would
+		self.row++
+		self.col = 0
+		self.line()
+	case b == '\b':
+		if self.col > 0 {
+			self.col--
+		}
+	case b == '\t':
+		self.col = (self.col/8 + 1) * 8
+		self.clamp()
+	case b == '\f':
+		self.clear()
+		self.row, self.col = 0, 0
+	case b == 0 || b == 0x07:
+	case b < 0x20 || b >= 0x7f:
+		self.put('.')
+	default:
+		self.put(rune(b))
+	}
+}
+
+// escDone is true once esc holds a whole escape sequence
+func escDone(esc []byte) bool {
+	if len(esc) < 2 {
+		return false
+	}
+
+	last := esc[len(esc)-1]
+	switch esc[1] {
+	case '[':
+		return len(esc) > 2 && last >= 0x40 && last <= 0x7e
+	case ']':
+		// OSC, ended by BEL or ESC \
+		return last == 0x07 || (last == '\\' && esc[len(esc)-2] == 0x1b)
+	case '(', ')', '#':
+		return len(esc) == 3
+	}
+	return true
+}
+
+// params are a CSI sequence's numbers, with def for missing ones
+func params(s string, n, def int) []int {
+	ps := make([]int, n)
+	toks := strings.Split(s, ";")
+	for i := range ps {
+		ps[i] = def
+		if i < len(toks) {
+			if v, err := strconv.Atoi(toks[i]); err == nil {
+				ps[i] = v
+			}
+		}
+	}
+	return ps
+}
+
+func (self *terminal) escape(esc []byte) {
+	switch esc[1] {
+	case 'c':
+		*self = terminal{fed: self.fed}
+		return
+	case '7':
+		self.saveRow, self.saveCol = self.row-self.top(), self.col
+		return
+	case '8':
+		self.row, self.col = self.top()+self.saveRow, self.saveCol
+		self.clamp()
+		return
+	case '[':
+	default:
+		return
+	}
+
+	arg := string(esc[2 : len(esc)-1])
+	if strings.HasPrefix(arg, "?") {
+		return // private modes, like hiding the cursor
+	}
+
+	p := params(arg, 2, 1)
+	n := p[0]
+	if n < 1 {
+		n = 1
+	}
+
+	final := esc[len(esc)-1]
+	switch final {
+	case 'A':
+		self.row -= n
+	case 'B':
+		self.row += n
+	case 'C':
+		self.col += n
+	case 'D':
+		self.col -= n
+	case 'E', 'F':
+		if final == 'F' {
+			n = -n
+		}
+		self.row += n
+		self.col = 0
+	case 'G':
+		self.col = n - 1
+	case 'H', 'f':
+		if p[1] < 1 {
+			p[1] = 1
+		}
+		self.row, self.col = self.top()+n-1, p[1]-1
+	case 'J':
+		switch params(arg, 1, 0)[0] {
+		case 0:
+			self.eraseLine(0)
+			if self.row+1 < len(self.lines) {
+				self.lines = self.lines[:self.row+1]
+			}
+		case 1:
+			for r := self.top(); r < self.row && r < len(self.lines); r++ {
+				self.lines[r] = nil
+			}
+			self.eraseLine(1)
+		default:
+			self.clear()
+		}
+	case 'K':
+		self.eraseLine(params(arg, 1, 0)[0])
+	case 'm':
+		if arg == "" || arg == "0" {
+			self.sgr = ""
+		} else if strings.HasPrefix(arg, "0;") {
+			self.sgr = "\x1b[" + arg[2:] + "m"
+		} else {
+			self.sgr += "\x1b[" + arg + "m"
+		}
+	case 's':
+		self.saveRow, self.saveCol = self.row-self.top(), self.col
+	case 'u':
+		self.row, self.col = self.top()+self.saveRow, self.saveCol
+	}
+
+	// the numbers came from the device; don't let them take the cursor (and
+	// so the lines we keep) anywhere silly
+	if strings.IndexByte("ABCDEFGHfu", final) != -1 {
+		self.clamp()
+	}
+}
+
+// eraseLine is EL: 0 erases to the end of the line, 1 to the cursor, 2 all
+func (self *terminal) eraseLine(how int) {
+	line := self.line()
+
+	switch how {
+	case 0:
+		if self.col < len(line) {
+			self.lines[self.row] = line[:self.col]
+		}
+	case 1:
+		for c := 0; c <= self.col && c < len(line); c++ {
+			line[c] = cell{ch: ' '}
+		}
+	default:
+		self.lines[self.row] = nil
+	}
+}
+
+func (self *terminal) String() string {
+	var buf bytes.Buffer
+
+	for r, line := range self.lines {
+		if r > 0 {
+			buf.WriteByte('\n')
+		}
+
+		sgr := ""
+		for _, c := range line {
+			if c.sgr != sgr {
+				buf.WriteString("\x1b[0m" + c.sgr)
+				sgr = c.sgr
+			}
+			buf.WriteRune(c.ch)
+		}
+		if sgr != "" {
+			buf.WriteString("\x1b[0m")
+		}
+	}
+
+	return buf.String()
+}
+
+// escapeBytes spells out everything that isn't printable, for the
+// "escaped" mode; newlines stay newlines too, so it's still readable
+func escapeBytes(buf []byte) string {
+	var out bytes.Buffer
+
+	for _, b := range buf {
+		switch {
+		case b == '\n':
+			out.WriteString("\\n\n")
+		case b == '\r':
+			out.WriteString("\\r")
+		case b == '\t':
+			out.WriteString("\\t")
+		case b == '\b':
+			out.WriteString("\\b")
+		case b == 0x1b:
+			out.WriteString("\\e")
+		case b == '\\':
+			out.WriteString("\\\\")
+		case b < 0x20 || b >= 0x7f:
+			fmt.Fprintf(&out, "\\x%0.2x", b)
+		default:
+			out.WriteByte(b)
+		}
+	}
+
+	return out.String()
+}
+
+// hexdump is the "hex" mode: offset, 16 bytes, and them as text
+func hexdump(buf []byte) string {
+	var out bytes.Buffer
+
+	for off := 0; off < len(buf); off += 16 {
+		end := off + 16
+		if end > len(buf) {
+			end = len(buf)
+		}
+
+		fmt.Fprintf(&out, "%0.4x: ", off)
+		for i := off; i < off+16; i++ {
+			if i < end {
+				fmt.Fprintf(&out, "%0.2x ", buf[i])
+			} else {
+				out.WriteString("   ")
+			}
+		}
+
+		out.WriteString(" ")
+		for _, b := range buf[off:end] {
+			if b < 0x20 || b >= 0x7f {
+				b = '.'
+			}
+			out.WriteByte(b)
+		}
+		out.WriteString("\n")
+	}
+
+	return out.String()
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Colors. Each thing we color has a role, and the theme maps roles to ANSI
+// attributes. There's a dark theme (the default) and a light one, and
+// "theme.cfg" in the current directory, if there is one, is loaded over
+// the default at startup; it's lines of
+//
+//   role: attributes
+//
+// where attributes are any of black red green yellow blue magenta cyan
+// white, on-<color> for the background, bold underline reverse, raw SGR
+// numbers, or "none". The roles are:
+//
+//   branch call load alu       instruction classes in the listing
+//   register immediate symbol  operands
+//   pc breakpoint              whole listing lines
+//   changed                    bytes and values that changed since the last stop
+
+var themes = map[string]map[string]string{
+	"dark": {
+		"branch":     "yellow",
+		"call":       "magenta bold",
+		"load":       "cyan",
+		"alu":        "green",
+		"register":   "bold",
+		"immediate":  "red",
+		"symbol":     "blue bold",
+		"pc":         "reverse",
+		"breakpoint": "red bold",
+		"changed":    "red bold",
+	},
+	"light": {
+		"branch":     "red",
+		"call":       "magenta bold",
+		"load":       "blue",
+		"alu":        "green",
+		"register":   "bold",
+		"immediate":  "cyan",
+		"symbol":     "blue underline",
+		"pc":         "reverse",
+		"breakpoint": "red bold",
+		"changed":    "red bold underline",
+	},
+}
+
+// theme is the current role -> escape sequence mapping; an empty one means
+// no color at all
+var theme = map[string]string{}
+
+var sgrColors = map[string]int{
+	"black": 0, "red": 1, "green": 2, "yellow": 3,
+	"blue": 4, "magenta": 5, "cyan": 6, "white": 7,
+}
+
+var sgrAttrs = map[string]int{
+	"bold": 1, "underline": 4, "reverse": 7,
+}
+
+// sgr turns "red bold" into the escape sequence for it
+func sgr(spec string) (string, error) {
+	codes := []string{}
+
+	for _, word := range strings.Fields(strings.ToLower(spec)) {
+		bg := strings.HasPrefix(word, "on-")
+
+		switch c, isColor := sgrColors[strings.TrimPrefix(word, "on-")]; {
+		case word == "none":
+		case isColor && bg:
+			codes = append(codes, strconv.Itoa(40+c))
+		case isColor:
+			codes = append(codes, strconv.Itoa(30+c))
+		case sgrAttrs[word] != 0:
+			codes = append(codes, strconv.Itoa(sgrAttrs[word]))
+		default:
+			if _, err := strconv.Atoi(word); err != nil {
+				return "", fmt.Errorf("unknown color '%s'", word)
+			}
+			codes = append(codes, word)
+		}
+	}
+
+	if len(codes) == 0 {
+		return "", nil
+	}
+
+	return "\x1b[" + strings.Join(codes, ";") + "m", nil
+}
+
+// setTheme switches to a built-in theme, or to no color for "off"
+func setTheme(name string) error {
+	if name == "off" {
+		theme = map[string]string{}
+		return nil
+	}
+
+	specs, ok := themes[name]
+	if !ok {
+		return fmt.Errorf("no theme named %s", name)
+	}
+
+	next := map[string]string{}
+	for role, spec := range specs {
+		code, err := sgr(spec)
+		if err != nil {
+			return err
+		}
+		next[role] = code
+	}
+
+	theme = next
+	return nil
+}
+
+// loadTheme reads a theme file over the current theme
+func loadTheme(file string) error {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	next := map[string]string{}
+	for role, code := range theme {
+		next[role] = code
+	}
+
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tups := strings.SplitN(line, ":", 2)
+		if len(tups) != 2 {
+			return fmt.Errorf("%s:%d: expected \"role: attributes\"", file, i+1)
+		}
+
+		code, err := sgr(tups[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", file, i+1, err)
+		}
+
+		next[strings.TrimSpace(tups[0])] = code
+	}
+
+	theme = next
+	return nil
+}
+
+// color wraps s in the attributes for role, if it has any
+func color(role, s string) string {
+	if code := theme[role]; code != "" && s != "" {
+		return code + s + "\x1b[0m"
+	}
+	return s
+}
+
+// insnClass sorts a mnemonic into one of the instruction roles
+func insnClass(m string) string {
+	switch m {
+	case "RJMP", "JMP", "IJMP", "EIJMP", "CPSE", "SBRC", "SBRS", "SBIC", "SBIS":
+		return "branch"
+	case "CALL", "RCALL", "ICALL", "EICALL", "RET", "RETI":
+		return "call"
+	case "PUSH", "POP", "IN", "OUT", "MOV", "MOVW", "XCH", "LAS", "LAC", "LAT":
+		return "load"
+	case "NOP", "SLEEP", "WDR", "BREAK":
+		return ""
+	}
+
+	switch {
+	case strings.HasPrefix(m, "BR"):
+		return "branch"
+	case strings.HasPrefix(m, "LD"), strings.HasPrefix(m, "ST"),
+		strings.HasPrefix(m, "LPM"), strings.HasPrefix(m, "ELPM"), strings.HasPrefix(m, "SPM"):
+		return "load"
+	}
+
+	return "alu"
+}
+
+func themeCommand(toks []string) bool {
+	if len(toks) < 2 {
+		roles := []string{}
+		for role := range theme {
+			roles = append(roles, role)
+		}
+		sort.Strings(roles)
+
+		for _, role := range roles {
+			logf("%s", color(role, role))
+		}
+
+		if len(roles) == 0 {
+			logf("colors are off")
+		}
+		return true
+	}
+
+	var err error
+	if toks[1] == "load" && len(toks) > 2 {
+		err = loadTheme(toks[2])
+	} else {
+		err = setTheme(toks[1])
+	}
+
+	if err != nil {
+		logf("%s", err)
+		return false
+	}
+
+	Listing.redraw()
+	redraw()
+
+	return true
+}
+
+func init() {
+	setTheme("dark")
+
+	// no theme.cfg is fine; a broken one isn't
+	if err := loadTheme("theme.cfg"); err != nil && !os.IsNotExist(err) {
+		logEarly("%s", err)
+	}
+}
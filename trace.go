@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/jroimartin/gocui"
+)
+
+// The execution trace. While tracing is on, every CPU state we see (from the
+// status poll, from "step", and from every instruction single-stepped by
+// the watcher) gets appended to a bounded ring of entries, so when the
+// device faults we can look back at how it got there. Each entry also keeps
+// a copy of the memory under the stack and dump tabs at the time, which is
+// what lets "rstep" and friends (history.go) show past states. An entry is
+// the state before its instruction runs, so the registers that instruction
+// changed are filled in when the next entry arrives.
+
+// traceSize is the default number of entries we keep
+const traceSize = 500
+
+// memSnap is a copy of a range of data memory
+type memSnap struct {
+	addr  uint16
+	bytes []byte
+}
+
+type traceEntry struct {
+	n      int // sequence number since "trace start"
+	pc     int
+	insn   string
+	sp     uint16
+	sr     string
+	srval  int
+	status int
+	regs   []string
+	diff   string  // registers insn changed, once the next entry is in
+	stack  memSnap // what the stack tab would have shown
+	mem    memSnap // what the dump tab would have shown
+}
+
+// stat rebuilds the status message this entry was recorded from
+func (self *traceEntry) stat() *StatMsg {
+	return &StatMsg{
+		Cpu: ApuState{
+			Pc:        self.pc,
+			Sp:        fmt.Sprintf("%0.4x", self.sp),
+			Sr:        self.sr,
+			SrVal:     self.srval,
+			Registers: self.regs,
+		},
+		Status: self.status,
+	}
+}
+
+func (self *traceEntry) String() string {
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "%.6d %-28s sp:%0.4x [%s]", self.n, self.insn, self.sp, self.sr)
+	if self.diff != "" {
+		fmt.Fprintf(out, "  %s", self.diff)
+	}
+	if self.status == 3 {
+		fmt.Fprintf(out, "  %s", statuses[3])
+	}
+	return out.String()
+}
+
+type tracer struct {
+	c       chan event
+	lock    sync.Mutex
+	on      bool
+	entries []traceEntry
+	size    int
+	count   int
+	written bool
+}
+
+func (self *tracer) deliver(e event) {
+	self.c <- e
+}
+
+func (self *tracer) makechan() {
+	self.c = make(chan event)
+}
+
+func (self *tracer) start() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.size == 0 {
+		self.size = traceSize
+	}
+
+	self.entries = nil
+	self.count = 0
+	self.on = true
+	self.written = false
+	logf("tracing (keeping the last %d states)", self.size)
+}
+
+func (self *tracer) stop() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.on = false
+	logf("stopped tracing; %d states recorded", self.count)
+}
+
+// tracing returns whether we're tracing and how many states we've recorded
+func (self *tracer) tracing() (on bool, count int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.on, self.count
+}
+
+// redraw has the trace tab draw again, to move the history marker
+func (self *tracer) redraw() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.written = false
+}
+
+func (self *tracer) resize(n int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if n < 1 {
+		n = traceSize
+	}
+
+	self.size = n
+	if len(self.entries) > n {
+		self.entries = self.entries[len(self.entries)-n:]
+	}
+
+	self.written = false
+}
+
+// regDiff describes the registers that changed between last and cpu
+func regDiff(last *traceEntry, cpu *ApuState) string {
+	diff := &bytes.Buffer{}
+	for i, reg := range cpu.Registers {
+		if i < len(last.regs) && last.regs[i] != reg {
+			fmt.Fprintf(diff, "r%d:%s>%s ", i, last.regs[i], reg)
+		}
+	}
+
+	if last.sp != cpu.sp() {
+		fmt.Fprintf(diff, "sp:%0.4x>%0.4x ", last.sp, cpu.sp())
+	}
+
+	return string(bytes.TrimRight(diff.Bytes(), " "))
+}
+
+// record appends a CPU state to the trace if we're tracing and it differs
+// from the last thing we recorded; it's safe to call from any component.
+// The entry before it gets the registers its instruction changed.
+func (self *tracer) record(stat *StatMsg) {
+	cpu := &stat.Cpu
+
+	// compare with the last entry, but don't hold the lock (which draw
+	// needs) across the peeks below
+	self.lock.Lock()
+	if !self.on {
+		self.lock.Unlock()
+		return
+	}
+	if n := len(self.entries); n > 0 {
+		last := &self.entries[n-1]
+		if last.pc == cpu.Pc && last.sr == cpu.Sr && regDiff(last, cpu) == "" {
+			self.lock.Unlock()
+			return
+		}
+	}
+	self.lock.Unlock()
+
+	insn := fmt.Sprintf("%0.4x:", cpu.Pc)
+	if i := Listing.insnAt(cpu.Pc); i != nil {
+		insn = i.String()
+	}
+
+	saddr, ssize := Stack.window(cpu.sp())
+	stack := memSnap{addr: saddr, bytes: peek(saddr, ssize)}
+
+	daddr, dsize := Dump.window()
+	mem := memSnap{addr: daddr}
+	if dsize > 0 {
+		mem.bytes = peek(daddr, dsize)
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if !self.on {
+		return
+	}
+
+	// something else may have been recorded while we were peeking, so
+	// this is the last entry now
+	if n := len(self.entries); n > 0 {
+		last := &self.entries[n-1]
+		last.diff = regDiff(last, cpu)
+	}
+
+	self.count++
+	self.entries = append(self.entries, traceEntry{
+		n:      self.count,
+		pc:     cpu.Pc,
+		insn:   insn,
+		sp:     cpu.sp(),
+		sr:     cpu.Sr,
+		srval:  cpu.SrVal,
+		status: stat.Status,
+		regs:   append([]string{}, cpu.Registers...),
+		stack:  stack,
+		mem:    mem,
+	})
+
+	if len(self.entries) > self.size {
+		self.entries = self.entries[len(self.entries)-self.size:]
+	}
+
+	self.written = false
+}
+
+// find returns a copy of the entry with sequence number n, or nil if it
+// isn't (or is no longer) in the trace
+func (self *tracer) find(n int) *traceEntry {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if len(self.entries) == 0 {
+		return nil
+	}
+
+	i := n - self.entries[0].n
+	if i < 0 || i >= len(self.entries) {
+		return nil
+	}
+
+	e := self.entries[i]
+	return &e
+}
+
+// bounds returns the sequence numbers of the oldest and newest entries we
+// still have, or zeroes if the trace is empty
+func (self *tracer) bounds() (first, last int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if len(self.entries) == 0 {
+		return
+	}
+
+	return self.entries[0].n, self.entries[len(self.entries)-1].n
+}
+
+func (self *tracer) draw(v *gocui.View, refresh bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if refresh {
+		self.written = false
+	}
+
+	if self.written {
+		return
+	}
+
+	v.Clear()
+
+	if len(self.entries) == 0 {
+		if self.on {
+			fmt.Fprintf(v, "tracing; nothing recorded yet\n")
+		} else {
+			fmt.Fprintf(v, "not tracing ('trace start' to begin)\n")
+		}
+	}
+
+	for i := range self.entries {
+		if self.entries[i].n == History.cursor {
+			fmt.Fprintf(v, "%s  <<\n", self.entries[i].String())
+		} else {
+			fmt.Fprintln(v, self.entries[i].String())
+		}
+	}
+
+	self.written = true
+}
+
+func (self *tracer) save(file string) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		logf("can't open %s: %s", file, err)
+		return
+	}
+
+	self.lock.Lock()
+	for i := range self.entries {
+		fmt.Fprintf(f, "%s\n", self.entries[i].String())
+	}
+	self.lock.Unlock()
+
+	logf("saved to %s", file)
+
+	f.Close()
+}
+
+func (self *tracer) loop() {
+	for {
+		e := <-self.c
+		switch e.kind {
+		case SAVE:
+			self.save(e.data)
+		}
+	}
+}
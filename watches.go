@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jroimartin/gocui"
+)
+
+// The "watch" tab: expressions added with "display" are re-evaluated every
+// time the status poll sees the PC move, and shown with the value they had
+// the time before. When we're looking at history they're evaluated against
+// the recorded state instead, memory and all. (Not to be confused with
+// watchpoints, which are what the "watch" command sets.)
+
+type watchExpr struct {
+	src  string
+	cur  string
+	prev string
+}
+
+type watches struct {
+	c       chan event
+	lock    sync.Mutex
+	exprs   []*watchExpr
+	lastpc  int
+	past    *traceEntry
+	written bool
+}
+
+func (self *watches) deliver(e event) {
+	self.c <- e
+}
+
+func (self *watches) makechan() {
+	self.c = make(chan event)
+}
+
+func (self *watches) add(src string) {
+	self.lock.Lock()
+	self.exprs = append(self.exprs, &watchExpr{src: src})
+	n := len(self.exprs)
+	self.lock.Unlock()
+
+	logf("display %d: %s", n, src)
+	self.deliver(event{kind: EVAL})
+}
+
+// remove deletes expression n (from 1), or all of them if n is -1
+func (self *watches) remove(n int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if n == -1 {
+		self.exprs = nil
+	} else if n < 1 || n > len(self.exprs) {
+		logf("no display %d", n)
+		return
+	} else {
+		self.exprs = append(self.exprs[:n-1], self.exprs[n:]...)
+	}
+
+	self.written = false
+	redraw()
+}
+
+func (self *watches) list() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for i, w := range self.exprs {
+		logf("%d: %s = %s", i+1, w.src, w.cur)
+	}
+
+	if len(self.exprs) == 0 {
+		logf("no displays")
+	}
+}
+
+// eval re-evaluates expressions against the state we're showing; if fresh
+// is set, only the ones that have never been evaluated
+func (self *watches) eval(fresh bool) {
+	ctx := &evalContext{past: History.entry()}
+	if ctx.past != nil {
+		ctx.cpu = &ctx.past.stat().Cpu
+	} else {
+		cpu := CurrentStatus.stat.Cpu
+		ctx.cpu = &cpu
+	}
+
+	self.lock.Lock()
+	exprs := append([]*watchExpr{}, self.exprs...)
+	self.lock.Unlock()
+
+	for _, w := range exprs {
+		if fresh && w.cur != "" {
+			continue
+		}
+
+		cur := ""
+		if v, err := evaluate(w.src, ctx); err != nil {
+			cur = fmt.Sprintf("<%s>", err)
+		} else {
+			cur = ctx.describe(v, 0)
+		}
+
+		self.lock.Lock()
+		w.prev, w.cur = w.cur, cur
+		self.lock.Unlock()
+	}
+
+	self.lock.Lock()
+	self.past = ctx.past
+	self.lock.Unlock()
+
+	self.written = false
+	redraw()
+}
+
+func (self *watches) draw(v *gocui.View, refresh bool) {
+	if refresh {
+		self.written = false
+	}
+
+	if self.written {
+		return
+	}
+
+	v.Clear()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.past != nil {
+		fmt.Fprintf(v, "HISTORICAL STATE #%d\n", self.past.n)
+	}
+
+	if len(self.exprs) == 0 {
+		fmt.Fprintf(v, "no expressions; add one with \"display <expr>\"\n")
+	}
+
+	for i, w := range self.exprs {
+		if w.prev != "" && w.prev != w.cur {
+			fmt.Fprintf(v, "%2d  %-20s %s  (was %s)\n", i+1, w.src, color("changed", w.cur), w.prev)
+		} else {
+			fmt.Fprintf(v, "%2d  %-20s %s\n", i+1, w.src, w.cur)
+		}
+	}
+
+	self.written = true
+}
+
+func (self *watches) loop() {
+	for {
+		e := <-self.c
+		switch e.kind {
+		case FETCH_LIVE:
+			if e.addr != self.lastpc {
+				self.lastpc = e.addr
+				self.eval(false)
+			}
+		case HISTORY:
+			self.eval(false)
+		case EVAL:
+			self.eval(true)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Software watchpoints. The emulator API doesn't know anything about
+// watching memory, so we do it the slow way: single-step the device with
+// /device/step, and after every step re-peek the watched bytes and compare
+// them with what we saw last time. Reads don't change memory, so for read
+// watchpoints we decode the instruction at PC before stepping it and work
+// out what address it's going to load from. Like gdb, "watch" traps writes,
+// "rwatch" reads, and "awatch" both.
+
+// watchStepLimit is how many instructions we'll single-step looking for a
+// hit before giving up; it's a lot of HTTP requests
+const watchStepLimit = 10000
+
+type watchpoint struct {
+	addr   uint16
+	size   int
+	reads  bool // trap loads
+	writes bool // trap stores
+	last   []byte
+}
+
+func (self *watchpoint) String() string {
+	kind := "write"
+	switch {
+	case self.reads && self.writes:
+		kind = "read/write"
+	case self.reads:
+		kind = "read"
+	}
+
+	if self.size == 1 {
+		return fmt.Sprintf("%0.4x (%s)", self.addr, kind)
+	}
+
+	return fmt.Sprintf("%0.4x-%0.4x (%s)", self.addr, int(self.addr)+self.size-1, kind)
+}
+
+type watcher struct {
+	c      chan event
+	lock   sync.Mutex
+	points []*watchpoint
+
+	// these are set from the command line and read while we step, so
+	// they're under lock too
+	running bool
+	stop    bool
+}
+
+func (self *watcher) deliver(e event) {
+	self.c <- e
+}
+
+func (self *watcher) makechan() {
+	self.c = make(chan event)
+}
+
+func (self *watcher) add(addr uint16, size int, reads, writes bool) {
+	if size < 1 {
+		size = 1
+	}
+
+	if size > 2048 {
+		size = 2048
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	w := &watchpoint{addr: addr, size: size, reads: reads, writes: writes}
+	self.points = append(self.points, w)
+	logf("watchpoint %d: %s", len(self.points)-1, w)
+}
+
+// remove deletes watchpoint n, or all of them if n is -1
+func (self *watcher) remove(n int) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if n == -1 {
+		self.points = nil
+		return true
+	}
+
+	if n < 0 || n >= len(self.points) {
+		return false
+	}
+
+	self.points = append(self.points[:n], self.points[n+1:]...)
+	return true
+}
+
+func (self *watcher) list() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	logf("All watchpoints:")
+	logf("----------------")
+	for i, w := range self.points {
+		logf("%.3d.  %s", i, w)
+	}
+	logf("")
+}
+
+// active is true if "continue" should single-step instead of letting the
+// device run
+func (self *watcher) active() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return len(self.points) > 0
+}
+
+// isRunning is true while we're single-stepping
+func (self *watcher) isRunning() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.running
+}
+
+// cancel stops a single-stepping run at the next instruction
+func (self *watcher) cancel() {
+	self.lock.Lock()
+	self.stop = true
+	self.lock.Unlock()
+}
+
+func (self *watcher) stopped() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.stop
+}
+
+// run single-steps the device until a watchpoint fires, we reach target (if
+// it isn't -1), we land on a breakpoint, the device faults, we've taken
+// watchStepLimit steps, or somebody cancels us. It's also how "runto" works
+// while we're tracing, so every instruction on the way gets recorded
+func (self *watcher) run(target int) {
+	self.lock.Lock()
+	self.running = true
+	self.stop = false
+	self.lock.Unlock()
+
+	defer func() {
+		self.lock.Lock()
+		self.running = false
+		self.lock.Unlock()
+
+		clearTempBreakpoints()
+		updateStatus()
+	}()
+
+	self.lock.Lock()
+	for _, w := range self.points {
+		w.last = peek(w.addr, w.size)
+	}
+	self.lock.Unlock()
+
+	bps := allBreakpoints()
+
+	cur, err := fetchStatus()
+	if err != nil {
+		logError("watch", err)
+		return
+	}
+
+	logf("single-stepping ('step' to stop)")
+
+	for i := 0; i < watchStepLimit; i++ {
+		if self.stopped() {
+			logf("stopped at %0.4x after %d steps", cur.Cpu.Pc, i)
+			return
+		}
+
+		pc := cur.Cpu.Pc
+		insn := Listing.insnAt(pc)
+
+		res, err := Session.post("/device/step", "")
+		if !res.OK(err) {
+			return
+		}
+
+		next, err := fetchStatus()
+		if err != nil {
+			logError("watch", err)
+			return
+		}
+
+		Trace.record(&next)
+
+		if self.check(pc, insn, &cur.Cpu) {
+			return
+		}
+
+		cur = next
+
+		if cur.Cpu.Pc == target {
+			logf("reached %0.4x after %d steps", target, i+1)
+			return
+		}
+
+		if cur.Status == 3 {
+			logf("device faulted at %0.4x", cur.Cpu.Pc)
+			return
+		}
+
+		for _, bp := range bps {
+			if uint16(cur.Cpu.Pc) == bp {
+				logf("hit breakpoint at %0.4x", bp)
+				return
+			}
+		}
+	}
+
+	logf("gave up after %d steps", watchStepLimit)
+}
+
+// check compares every watchpoint with memory after the instruction at pc
+// (insn, run with the registers in cpu) was stepped, and reports any that
+// fired
+func (self *watcher) check(pc int, insn *Instruction, cpu *ApuState) (hit bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	what := fmt.Sprintf("%0.4x", pc)
+	acc, accok := access{}, false
+	if insn != nil {
+		what = insn.String()
+		acc, accok = dataAccess(insn, cpu)
+	}
+
+	for _, w := range self.points {
+		if w.reads && accok && !acc.write && acc.overlaps(w.addr, w.size) {
+			logf("watch: %s read %0.4x at pc %0.4x: %s", w, acc.addr, pc, what)
+			hit = true
+		}
+
+		now := peek(w.addr, w.size)
+		if now == nil {
+			continue
+		}
+
+		if w.writes && w.last != nil && !bytes.Equal(now, w.last) {
+			logf("watch: %s written at pc %0.4x: %s", w, pc, what)
+			logf("  old: % x", w.last)
+			logf("  new: % x", now)
+			hit = true
+		}
+
+		w.last = now
+	}
+
+	return
+}
+
+func (self *watcher) loop() {
+	for {
+		e := <-self.c
+		switch e.kind {
+		case WATCH_RUN:
+			self.run(e.addr)
+		}
+	}
+}
+
+// access describes a data memory load or store an instruction is about to
+// make
+type access struct {
+	addr  uint16
+	size  int
+	write bool
+}
+
+func (self access) overlaps(addr uint16, size int) bool {
+	return int(self.addr) < int(addr)+size && int(addr) < int(self.addr)+self.size
+}
+
+// dataAccess decodes the data memory access insn will make when it runs with
+// the registers in cpu; ok is false for instructions that don't touch data
+// memory. The emulator's mnemonics for the indirect loads and stores are a
+// little inconsistent ("STX", "ST X+"), so we squash out spaces and accept
+// both spellings
+func dataAccess(insn *Instruction, cpu *ApuState) (acc access, ok bool) {
+	x, y, z := cpu.pair(26), cpu.pair(28), cpu.pair(30)
+	q := uint16(insn.Q)
+	sp := cpu.sp()
+
+	acc.size = 1
+	ok = true
+
+	switch strings.Replace(strings.ToUpper(insn.Opcode), " ", "", -1) {
+	case "LDX", "LDXP":
+		acc.addr = x
+	case "LDXM":
+		acc.addr = x - 1
+	case "LDY", "LDYP":
+		acc.addr = y
+	case "LDYM":
+		acc.addr = y - 1
+	case "LDYQ", "LDDY":
+		acc.addr = y + q
+	case "LDZ", "LDZP", "LAC", "LAS", "LAT", "XCH":
+		acc.addr = z
+	case "LDZM":
+		acc.addr = z - 1
+	case "LDZQ", "LDDZ":
+		acc.addr = z + q
+	case "LDS", "LDSX":
+		acc.addr = uint16(insn.K)
+	case "POP":
+		acc.addr = sp + 1
+	case "RET", "RETI":
+		acc.addr = sp + 1
+		acc.size = 2
+	case "ST", "STX", "STX+", "STXP":
+		acc.addr, acc.write = x, true
+	case "STX-", "STXM":
+		acc.addr, acc.write = x-1, true
+	case "STY", "STY+", "STYP":
+		acc.addr, acc.write = y, true
+	case "STY-", "STYM":
+		acc.addr, acc.write = y-1, true
+	case "STDY", "STDY+", "STYQ":
+		acc.addr, acc.write = y+q, true
+	case "STZ", "STZ+", "STZP":
+		acc.addr, acc.write = z, true
+	case "STZ-", "STZM":
+		acc.addr, acc.write = z-1, true
+	case "STDZ", "STDZ+", "STZQ":
+		acc.addr, acc.write = z+q, true
+	case "STS", "STSX":
+		acc.addr, acc.write = uint16(insn.K), true
+	case "PUSH":
+		acc.addr, acc.write = sp, true
+	case "CALL", "RCALL", "ICALL", "EICALL":
+		acc.addr, acc.write = sp-1, true
+		acc.size = 2
+	default:
+		ok = false
+	}
+
+	return
+}